@@ -0,0 +1,114 @@
+package yieldpoint
+
+import (
+	"sync"
+	"time"
+)
+
+// maxActivePeriods bounds how many finished active periods are kept for ActiveRatio
+const maxActivePeriods = 1024
+
+// activePeriod is a finished stretch of time during which a section was active
+type activePeriod struct {
+	start, end time.Time
+}
+
+var (
+	// activeMu serializes the active-period transitions and guards the variables below
+	activeMu sync.Mutex
+	// activeOpen is set while an active period is in progress
+	activeOpen bool
+	// activeStart is when the current active period started
+	activeStart time.Time
+	// activeTotal is the summed length of all finished active periods
+	activeTotal time.Duration
+	// activePeriods is a ring of the most recent finished active periods
+	activePeriods []activePeriod
+	// activeNext is the ring index the next finished period is written to
+	activeNext int
+)
+
+// markActive starts an active period after a 0→1 transition, along with its runtime/trace task.
+// Transitions can be observed out of order, so the count is re-checked under activeMu: a period
+// is only opened if sections are still active and none is open yet.
+func markActive() {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+
+	if activeOpen || HighPriorityCount.Load() == 0 {
+		return
+	}
+	activeOpen = true
+	activeStart = time.Now()
+	startSectionTask()
+}
+
+// markInactive ends the current active period after a transition to zero, along with its
+// runtime/trace task. It does nothing if a section became active again in the meantime.
+func markInactive() {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+
+	if !activeOpen || HighPriorityCount.Load() > 0 {
+		return
+	}
+	activeOpen = false
+	end := time.Now()
+	d := end.Sub(activeStart)
+	activeTotal += d
+	storeMax(&maxActiveNanos, int64(d))
+	endSectionTask()
+
+	if len(activePeriods) < maxActivePeriods {
+		activePeriods = append(activePeriods, activePeriod{activeStart, end})
+	} else {
+		activePeriods[activeNext] = activePeriod{activeStart, end}
+		activeNext = (activeNext + 1) % maxActivePeriods
+	}
+}
+
+// ActiveTime returns the total wall-clock time during which at least one high-priority
+// section has been active, including the current period if one is in progress.
+// It never decreases.
+func ActiveTime() time.Duration {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+
+	total := activeTotal
+	if activeOpen {
+		total += time.Since(activeStart)
+	}
+	return total
+}
+
+// ActiveRatio returns the fraction of the last window during which at least one high-priority
+// section was active, between 0 and 1. Only the most recent 1024 active periods are remembered,
+// so very long windows over frequently toggling sections are underestimated.
+func ActiveRatio(window time.Duration) float64 {
+	if window <= 0 {
+		return 0
+	}
+	now := time.Now()
+	from := now.Add(-window)
+
+	var active time.Duration
+	overlap := func(start, end time.Time) {
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(start) {
+			active += end.Sub(start)
+		}
+	}
+
+	activeMu.Lock()
+	if activeOpen {
+		overlap(activeStart, now)
+	}
+	for _, p := range activePeriods {
+		overlap(p.start, p.end)
+	}
+	activeMu.Unlock()
+
+	return min(float64(active)/float64(window), 1)
+}
@@ -0,0 +1,76 @@
+package yieldpoint
+
+import (
+	"sync"
+	"time"
+)
+
+// YieldBudget bounds the total time a group of goroutines spends sleeping in yields.
+// Sleep time is drawn from a token bucket; when it runs dry, yields fall back to a regular yield.
+// A YieldBudget is safe for concurrent use.
+type YieldBudget struct {
+	mu     sync.Mutex
+	refill time.Duration
+	burst  time.Duration
+	level  time.Duration
+	last   time.Time
+}
+
+// NewYieldBudget returns a full YieldBudget that regains refillPerSecond of sleep time
+// every second and holds at most burst.
+func NewYieldBudget(refillPerSecond, burst time.Duration) *YieldBudget {
+	return &YieldBudget{
+		refill: refillPerSecond,
+		burst:  burst,
+		level:  burst,
+		last:   time.Now(),
+	}
+}
+
+// MaybeYield yields if any high-priority sections are active. It sleeps for the default
+// yield duration when that much time can be reserved from the budget, and otherwise yields
+// like the package-level MaybeYield. Either way it honors test mode, the yield decider,
+// SetYieldBudget and WithPriorityCeiling, and the yield is counted and traced like any other.
+func (b *YieldBudget) MaybeYield() {
+	depth := HighPriorityCount.Load()
+	if depth == 0 || holdsCeiling() || !yieldAllowed(depth) || !yieldWithinBudget() {
+		return
+	}
+
+	var sleep time.Duration
+	if d := GetDefaultYieldDuration(); d > 0 && b.reserve(d) {
+		sleep = d
+	}
+	yieldFor(sleep)
+}
+
+// Level returns the sleep time currently available in the budget.
+func (b *YieldBudget) Level() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refillLocked(time.Now())
+	return b.level
+}
+
+// reserve takes d from the budget if enough is available.
+func (b *YieldBudget) reserve(d time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refillLocked(time.Now())
+	if b.level < d {
+		return false
+	}
+	b.level -= d
+	return true
+}
+
+// refillLocked adds the sleep time earned since the last refill. b.mu must be held.
+func (b *YieldBudget) refillLocked(now time.Time) {
+	elapsed := now.Sub(b.last)
+	if elapsed <= 0 {
+		return
+	}
+	b.last = now
+	earned := time.Duration(float64(b.refill) * elapsed.Seconds())
+	b.level = min(b.level+earned, b.burst)
+}
@@ -0,0 +1,63 @@
+package yieldpoint
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// ceilingHolders counts the goroutines currently inside WithPriorityCeiling
+	ceilingHolders atomic.Int32
+	// ceilingMu guards ceilingDepths
+	ceilingMu sync.Mutex
+	// ceilingDepths holds the WithPriorityCeiling nesting depth of each goroutine inside one
+	ceilingDepths = make(map[uint64]int)
+)
+
+// WithPriorityCeiling runs fn inside a high-priority section and exempts the calling goroutine
+// from yielding and waiting until fn returns, so a low-priority goroutine holding a resource that
+// high-priority work needs can finish and release it instead of being parked behind that work.
+// Inside fn, the MaybeYield and WaitIfActive families return immediately on the calling goroutine,
+// even while paused, rather than waiting for the section fn itself holds. Other goroutines,
+// including those started by fn, treat the section like any other.
+// The section is exited when fn returns or panics.
+// With SetGoroutineDepthTracking enabled, GoroutineEnterDepth reports the boost inside fn.
+func WithPriorityCeiling(fn func()) {
+	id := getGoroutineID()
+	enterCeiling(id)
+	defer exitCeiling(id)
+
+	EnterHighPriority()
+	defer ExitHighPriority()
+	fn()
+}
+
+// enterCeiling records that goroutine id entered WithPriorityCeiling.
+func enterCeiling(id uint64) {
+	ceilingMu.Lock()
+	ceilingDepths[id]++
+	ceilingMu.Unlock()
+	ceilingHolders.Add(1)
+}
+
+// exitCeiling records that goroutine id left WithPriorityCeiling.
+func exitCeiling(id uint64) {
+	ceilingHolders.Add(-1)
+	ceilingMu.Lock()
+	if ceilingDepths[id]--; ceilingDepths[id] == 0 {
+		delete(ceilingDepths, id)
+	}
+	ceilingMu.Unlock()
+}
+
+// holdsCeiling reports whether the current goroutine is inside WithPriorityCeiling.
+// It costs a single load while no goroutine is.
+func holdsCeiling() bool {
+	if ceilingHolders.Load() == 0 {
+		return false
+	}
+	id := getGoroutineID()
+	ceilingMu.Lock()
+	defer ceilingMu.Unlock()
+	return ceilingDepths[id] > 0
+}
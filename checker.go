@@ -0,0 +1,32 @@
+package yieldpoint
+
+import "context"
+
+// Checker amortizes MaybeYieldWithContext over many loop iterations.
+// It only consults the context and the high-priority count once every n calls to Check.
+// A Checker is not safe for concurrent use; give each goroutine its own.
+type Checker struct {
+	ctx   context.Context
+	every int
+	n     int
+}
+
+// NewChecker returns a Checker that performs a full yield check once every `every` calls.
+// Values below 1 make every call a full check.
+func NewChecker(ctx context.Context, every int) *Checker {
+	if every < 1 {
+		every = 1
+	}
+	return &Checker{ctx: ctx, every: every}
+}
+
+// Check counts one iteration and, when due, yields if high priority is active.
+// It returns the context's error once the context is done.
+func (c *Checker) Check() error {
+	c.n++
+	if c.n < c.every {
+		return nil
+	}
+	c.n = 0
+	return MaybeYieldWithContext(c.ctx)
+}
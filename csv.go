@@ -0,0 +1,132 @@
+package yieldpoint
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// csvHeader is the header row written by WriteCSV and CSVTracer.
+// Columns are only ever appended, so tools can rely on their positions.
+var csvHeader = []string{
+	"seq",
+	"goroutine_id",
+	"timestamp",
+	"reason",
+	"duration_us",
+	"caller_file",
+	"caller_line",
+	"caller_function",
+	"wakeups",
+	"spin_stage",
+	"generation",
+}
+
+// WriteCSV writes the recorded events to w as CSV, oldest first, after a header row.
+// seq numbers the rows from zero. Zero durations, wakeups and generations and unset caller fields and spin stages
+// are written as empty cells.
+func (r *Recorder) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	for i, e := range r.Snapshot() {
+		if err := cw.Write(csvRecord(uint64(i), e)); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// CSVTracer writes trace events to an io.Writer as CSV rows, in the same format as Recorder.WriteCSV.
+// The header row is written before the first event, and seq counts the events written so far.
+// Install it with AddTraceFunc(t.Trace) or SetTraceFunc(t.Trace).
+// Write errors never panic; they are counted and available from ErrorCount and LastError.
+type CSVTracer struct {
+	mu     sync.Mutex
+	cw     *csv.Writer
+	header bool
+	seq    uint64
+	err    error
+	errors atomic.Uint64
+}
+
+// NewCSVTracer returns a CSVTracer writing to w.
+func NewCSVTracer(w io.Writer) *CSVTracer {
+	return &CSVTracer{cw: csv.NewWriter(w)}
+}
+
+// Trace writes e as a single CSV row, preceded by the header row on the first call.
+func (t *CSVTracer) Trace(e YieldEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.header {
+		t.header = true
+		if err := t.cw.Write(csvHeader); err != nil {
+			t.recordLocked(err)
+			return
+		}
+	}
+	if err := t.cw.Write(csvRecord(t.seq, e)); err != nil {
+		t.recordLocked(err)
+		return
+	}
+	t.seq++
+	t.cw.Flush()
+	t.recordLocked(t.cw.Error())
+}
+
+// ErrorCount returns the number of rows that could not be written.
+func (t *CSVTracer) ErrorCount() uint64 {
+	return t.errors.Load()
+}
+
+// LastError returns the most recent write error, or nil if there has been none.
+func (t *CSVTracer) LastError() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+// recordLocked counts err, if any. t.mu must be held.
+func (t *CSVTracer) recordLocked(err error) {
+	if err != nil {
+		t.errors.Add(1)
+		t.err = err
+	}
+}
+
+// csvRecord formats e as a row matching csvHeader.
+func csvRecord(seq uint64, e YieldEvent) []string {
+	var duration, line, wakeups, gen string
+	if e.Duration != 0 {
+		duration = strconv.FormatFloat(float64(e.Duration)/float64(time.Microsecond), 'f', -1, 64)
+	}
+	if e.CallerLine != 0 {
+		line = strconv.Itoa(e.CallerLine)
+	}
+	if e.Wakeups != 0 {
+		wakeups = strconv.Itoa(e.Wakeups)
+	}
+	if e.Generation != 0 {
+		gen = strconv.FormatUint(e.Generation, 10)
+	}
+	return []string{
+		strconv.FormatUint(seq, 10),
+		strconv.FormatUint(e.GoroutineID, 10),
+		e.Timestamp.Format(time.RFC3339Nano),
+		e.Reason.String(),
+		duration,
+		e.CallerFile,
+		line,
+		e.CallerFunction,
+		wakeups,
+		e.SpinStage.String(),
+		gen,
+	}
+}
@@ -0,0 +1,41 @@
+package yieldpoint
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Errors returned by the context-aware functions: MaybeYieldWithContext, WaitIfActiveWithContext,
+// WaitIfActiveWithContextTimed, WaitForHighPriorityWithContext, WaitForDepthBelowWithContext,
+// AwaitQuiescence, RunCooperative and Checker.Check, and by WaitIfActiveLimited.
+//
+// ErrTimeout and ErrCancelled wrap the context's own error, so errors.Is matches both
+// the sentinel and context.DeadlineExceeded or context.Canceled.
+var (
+	// ErrTimeout is returned when the context's deadline passes.
+	ErrTimeout = errors.New("yieldpoint: timed out")
+
+	// ErrCancelled is returned when the context is cancelled.
+	ErrCancelled = errors.New("yieldpoint: cancelled")
+
+	// ErrShutdown is returned once Shutdown has been called, by every context-aware function
+	// above except AwaitQuiescence.
+	ErrShutdown = errors.New("yieldpoint: shut down")
+
+	// ErrTooManyWakeups is returned by WaitIfActiveLimited when the waiter keeps being woken
+	// only to find a new high-priority section already active.
+	ErrTooManyWakeups = errors.New("yieldpoint: too many wakeups while waiting")
+)
+
+// contextError returns the error of a done ctx wrapped in the matching sentinel.
+func contextError(ctx context.Context) error {
+	err := ctx.Err()
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	case errors.Is(err, context.Canceled):
+		return fmt.Errorf("%w: %w", ErrCancelled, err)
+	}
+	return err
+}
@@ -0,0 +1,39 @@
+// Command cooperative_loop shows a background worker that defers to a high-priority task
+// using RunCooperative instead of a hand-written yield loop.
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/AlexsanderHamir/yieldpoint"
+)
+
+func main() {
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := yieldpoint.RunCooperative(context.Background(), 10, func(i int) error {
+			fmt.Printf("background: step %d\n", i)
+			time.Sleep(10 * time.Millisecond)
+			return nil
+		})
+		if err != nil {
+			fmt.Println("background:", err)
+		}
+	}()
+
+	time.Sleep(25 * time.Millisecond)
+
+	yieldpoint.EnterHighPriority()
+	fmt.Println("high priority: started")
+	time.Sleep(30 * time.Millisecond)
+	fmt.Println("high priority: finished")
+	yieldpoint.ExitHighPriority()
+
+	wg.Wait()
+}
@@ -0,0 +1,37 @@
+// Command pacer shows a tight background loop that checks for high priority through a Pacer
+// instead of a hand-picked `if i%1024 == 0` stride.
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/AlexsanderHamir/yieldpoint"
+)
+
+func main() {
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		pacer := yieldpoint.NewPacer(0.01)
+		sum := 0
+		for i := range 50_000_000 {
+			pacer.Tick()
+			sum += i % 7
+		}
+		fmt.Printf("background: sum=%d, final stride=%d\n", sum, pacer.Stride())
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	yieldpoint.EnterHighPriority()
+	fmt.Println("high priority: started")
+	time.Sleep(20 * time.Millisecond)
+	fmt.Println("high priority: finished")
+	yieldpoint.ExitHighPriority()
+
+	wg.Wait()
+}
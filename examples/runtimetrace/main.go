@@ -0,0 +1,50 @@
+// Command runtimetrace writes a Go execution trace annotated by yieldpoint to trace.out.
+// Inspect it with: go tool trace trace.out
+package main
+
+import (
+	"log"
+	"os"
+	"runtime/trace"
+	"sync"
+	"time"
+
+	"github.com/AlexsanderHamir/yieldpoint"
+)
+
+func main() {
+	f, err := os.Create("trace.out")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := trace.Start(f); err != nil {
+		log.Fatal(err)
+	}
+	defer trace.Stop()
+
+	yieldpoint.EnableRuntimeTrace(true)
+	defer yieldpoint.EnableRuntimeTrace(false)
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			deadline := time.Now().Add(50 * time.Millisecond)
+			for time.Now().Before(deadline) {
+				yieldpoint.MaybeYield()
+				yieldpoint.WaitIfActive()
+			}
+		}()
+	}
+
+	for range 5 {
+		yieldpoint.EnterHighPriority()
+		time.Sleep(2 * time.Millisecond)
+		yieldpoint.ExitHighPriority()
+		time.Sleep(5 * time.Millisecond)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,32 @@
+// Command slog logs yieldpoint events through log/slog while a worker defers to a
+// short high-priority section.
+package main
+
+import (
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/AlexsanderHamir/yieldpoint"
+)
+
+func main() {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	remove := yieldpoint.TraceToSlog(logger)
+	defer remove()
+
+	yieldpoint.EnterHighPriority()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		yieldpoint.MaybeYield()
+		yieldpoint.WaitIfActive()
+	}()
+
+	time.Sleep(5 * time.Millisecond)
+	yieldpoint.ExitHighPriority()
+	wg.Wait()
+}
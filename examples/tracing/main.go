@@ -0,0 +1,45 @@
+// Command tracing prints every yieldpoint event produced by a worker deferring to a
+// short high-priority section.
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/AlexsanderHamir/yieldpoint"
+)
+
+func main() {
+	var mu sync.Mutex
+	var waited time.Duration
+	yieldpoint.SetTraceFunc(func(e yieldpoint.YieldEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch e.Reason {
+		case yieldpoint.ReasonWaitComplete, yieldpoint.ReasonWaitCompleteFast, yieldpoint.ReasonWaitCanceled:
+			waited += e.Duration
+		}
+		fmt.Printf("%s goroutine=%d reason=%s duration=%v\n",
+			e.Timestamp.Format("15:04:05.000000"), e.GoroutineID, e.Reason, e.Duration)
+	})
+	defer yieldpoint.SetTraceFunc(nil)
+
+	yieldpoint.EnterHighPriority()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		yieldpoint.MaybeYield()
+		yieldpoint.WaitIfActive()
+	}()
+
+	time.Sleep(5 * time.Millisecond)
+	yieldpoint.ExitHighPriority()
+	wg.Wait()
+
+	mu.Lock()
+	fmt.Printf("total time spent waiting: %v\n", waited)
+	mu.Unlock()
+}
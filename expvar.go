@@ -0,0 +1,38 @@
+package yieldpoint
+
+import (
+	"expvar"
+	"sync"
+)
+
+// expvarMu serializes PublishExpvar
+var expvarMu sync.Mutex
+
+// PublishExpvar publishes the package's live state as the expvar variable name, a JSON object with
+// the fields active_sections, waiters, yields, wait_time_ns, trace_dropped and yield_duration_ns,
+// and by_reason, an object mapping reason names to event counts.
+// Values are read from the package's counters whenever the variable is served.
+// Publishing a name that is already taken has no effect, so calling it twice is safe.
+func PublishExpvar(name string) {
+	expvarMu.Lock()
+	defer expvarMu.Unlock()
+
+	if expvar.Get(name) != nil {
+		return
+	}
+	expvar.Publish(name, expvar.Func(func() any {
+		byReason := make(map[string]uint64)
+		for r, n := range reasonCountsSnapshot() {
+			byReason[r.String()] = n
+		}
+		return map[string]any{
+			"active_sections":   HighPriorityCount.Load(),
+			"waiters":           waiters.Load(),
+			"yields":            yieldCount.Load(),
+			"wait_time_ns":      waitNanos.Load(),
+			"trace_dropped":     traceDropped.Load(),
+			"yield_duration_ns": yieldDuration.Load(),
+			"by_reason":         byReason,
+		}
+	}))
+}
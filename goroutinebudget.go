@@ -0,0 +1,80 @@
+package yieldpoint
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// goroutineYieldBudget is the number of yields each goroutine may perform per second, or zero for no limit
+var goroutineYieldBudget atomic.Int64
+
+// goroutineBudget is the yield count of one goroutine in its current one-second window
+type goroutineBudget struct {
+	windowStart time.Time
+	used        int64
+}
+
+var (
+	// goroutineBudgetsMu guards goroutineBudgets and goroutineBudgetsSwept
+	goroutineBudgetsMu sync.Mutex
+	// goroutineBudgets holds the current window of each goroutine that yielded recently
+	goroutineBudgets = make(map[uint64]*goroutineBudget)
+	// goroutineBudgetsSwept is when expired windows were last evicted
+	goroutineBudgetsSwept time.Time
+)
+
+// SetYieldBudget limits every goroutine to maxYieldsPerSecond yields of the MaybeYield family
+// per one-second window, including the sleeps of YieldBudget.MaybeYield. Once a goroutine has
+// used its budget, its yields are skipped until its window ends, and each skipped yield emits
+// a ReasonYieldSuppressed trace event. A non-positive limit, the default, removes the limit.
+// Changing the setting starts every goroutine on a fresh window.
+//
+// While a limit is set, each yield pays the per-goroutine cost described at SetGoroutineAccounting.
+// Calls that find no section active are not affected.
+func SetYieldBudget(maxYieldsPerSecond int) {
+	goroutineBudgetsMu.Lock()
+	defer goroutineBudgetsMu.Unlock()
+
+	clear(goroutineBudgets)
+	goroutineBudgetsSwept = time.Now()
+	goroutineYieldBudget.Store(int64(max(maxYieldsPerSecond, 0)))
+}
+
+// yieldBudgetAllows reports whether the current goroutine may yield under SetYieldBudget,
+// counting the yield if so.
+func yieldBudgetAllows() bool {
+	limit := goroutineYieldBudget.Load()
+	if limit == 0 {
+		return true
+	}
+	id := getGoroutineID()
+	now := time.Now()
+
+	goroutineBudgetsMu.Lock()
+	defer goroutineBudgetsMu.Unlock()
+
+	// Expired windows are the same as missing ones, so evicting them bounds the table
+	// to the goroutines that yielded during the last second.
+	if now.Sub(goroutineBudgetsSwept) >= time.Second {
+		goroutineBudgetsSwept = now
+		for gid, b := range goroutineBudgets {
+			if now.Sub(b.windowStart) >= time.Second {
+				delete(goroutineBudgets, gid)
+			}
+		}
+	}
+
+	b := goroutineBudgets[id]
+	if b == nil {
+		b = &goroutineBudget{windowStart: now}
+		goroutineBudgets[id] = b
+	} else if now.Sub(b.windowStart) >= time.Second {
+		b.windowStart, b.used = now, 0
+	}
+	if b.used >= limit {
+		return false
+	}
+	b.used++
+	return true
+}
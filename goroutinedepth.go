@@ -0,0 +1,110 @@
+package yieldpoint
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// trackGoroutineDepth is set while enters and exits are attributed to goroutines
+	trackGoroutineDepth atomic.Bool
+	// goroutineDepthMu guards goroutineDepths and untrackedSections
+	goroutineDepthMu sync.Mutex
+	// goroutineDepths holds the open section count of each goroutine that has one
+	goroutineDepths = make(map[uint64]int)
+	// untrackedSections counts sections that were already open when tracking was enabled
+	untrackedSections int
+	// selfWaitPanic makes a detected self-wait panic instead of returning
+	selfWaitPanic atomic.Bool
+)
+
+// SetGoroutineDepthTracking enables or disables attributing each section to the goroutine that
+// entered it. While enabled, an exit from a goroutine with no open sections of its own is ignored
+// and reported to the handler set with SetImbalanceHandler with a delta of 1, instead of ending
+// another goroutine's section. Sections already open when tracking is enabled may be exited by any goroutine.
+//
+// Tracking costs a stack read and a map update per enter and exit, and it rejects code that
+// legitimately exits on another goroutine, such as a PriorityRWMutex unlocked elsewhere.
+// Sections entered with EnterHighPriorityFor stay attributed to the goroutine that entered them,
+// so their timed exit is accepted.
+func SetGoroutineDepthTracking(enabled bool) {
+	goroutineDepthMu.Lock()
+	defer goroutineDepthMu.Unlock()
+
+	clear(goroutineDepths)
+	untrackedSections = 0
+	if enabled {
+		untrackedSections = int(HighPriorityCount.Load())
+	}
+	trackGoroutineDepth.Store(enabled)
+}
+
+// GoroutineEnterDepth returns the number of sections the current goroutine has entered and not
+// yet exited. It is always zero unless SetGoroutineDepthTracking is enabled.
+func GoroutineEnterDepth() int {
+	if !trackGoroutineDepth.Load() {
+		return 0
+	}
+	id := getGoroutineID()
+	goroutineDepthMu.Lock()
+	defer goroutineDepthMu.Unlock()
+	return goroutineDepths[id]
+}
+
+// InHighPrioritySection reports whether the current goroutine has entered a section that is
+// still open, as opposed to only observing sections entered by others, for example to decide
+// whether cleanup code should call ExitHighPriority. It needs SetGoroutineDepthTracking
+// and always reports false while tracking is disabled.
+func InHighPrioritySection() bool {
+	return GoroutineEnterDepth() > 0
+}
+
+// SetSelfWaitPanic chooses what happens when a goroutine that holds a section calls a
+// WaitIfActive variant or WaitForQuiet, which would otherwise wait for itself forever.
+// Detection needs SetGoroutineDepthTracking. By default the call treats the goroutine's
+// own sections as satisfied and returns immediately; with enabled set, meant for debugging,
+// it panics with a message naming the entry point. Either way a ReasonSelfWaitDetected
+// event is emitted first.
+func SetSelfWaitPanic(enabled bool) {
+	selfWaitPanic.Store(enabled)
+}
+
+// selfWait reports whether the current goroutine holds a section and so must not wait for
+// sections to clear in entry, tracing the self-wait and panicking if SetSelfWaitPanic is on.
+func selfWait(entry string) bool {
+	if !InHighPrioritySection() {
+		return false
+	}
+	traceYieldEvent(ReasonSelfWaitDetected, 0)
+	if selfWaitPanic.Load() {
+		panic("yieldpoint: " + entry + " called by a goroutine holding a high-priority section")
+	}
+	return true
+}
+
+// noteGoroutineEnter records a section entered by the current goroutine.
+func noteGoroutineEnter() {
+	id := getGoroutineID()
+	goroutineDepthMu.Lock()
+	goroutineDepths[id]++
+	goroutineDepthMu.Unlock()
+}
+
+// noteGoroutineExit records a section of goroutine id being exited and reports
+// whether the exit is allowed to end a section.
+func noteGoroutineExit(id uint64) bool {
+	goroutineDepthMu.Lock()
+	defer goroutineDepthMu.Unlock()
+
+	switch d := goroutineDepths[id]; {
+	case d > 1:
+		goroutineDepths[id] = d - 1
+	case d == 1:
+		delete(goroutineDepths, id)
+	case untrackedSections > 0:
+		untrackedSections--
+	default:
+		return false
+	}
+	return true
+}
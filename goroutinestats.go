@@ -0,0 +1,112 @@
+package yieldpoint
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// GoroutineStats is the yield and wait accounting of one goroutine.
+type GoroutineStats struct {
+	GoroutineID uint64
+	// Yields and Waits count the yields and blocking waits of the goroutine.
+	Yields uint64
+	Waits  uint64
+	// BlockedTime is the total time the goroutine spent yielding and waiting.
+	BlockedTime time.Duration
+	// LastSeen is when the goroutine last yielded or finished waiting.
+	LastSeen time.Time
+}
+
+var (
+	// goroutineAccounting is set while yields and waits are accounted per goroutine
+	goroutineAccounting atomic.Bool
+	// goroutineStatsMu guards goroutineStats, goroutineStatsTTL and goroutineStatsSwept
+	goroutineStatsMu sync.Mutex
+	// goroutineStats holds the accounting of each goroutine seen recently
+	goroutineStats = make(map[uint64]*GoroutineStats)
+	// goroutineStatsTTL is how long an idle goroutine's entry is kept
+	goroutineStatsTTL time.Duration
+	// goroutineStatsSwept is when idle entries were last evicted
+	goroutineStatsSwept time.Time
+)
+
+// SetGoroutineAccounting enables or disables accounting yields and waits per goroutine for
+// TopYielders. Entries for goroutines that have not yielded or waited for ttl are evicted, since
+// exited goroutines cannot be detected; a non-positive ttl defaults to one minute. Changing the
+// setting discards all entries.
+//
+// It is off by default: each accounted yield or wait reads the goroutine ID from runtime.Stack,
+// which costs around a microsecond, and takes a mutex.
+func SetGoroutineAccounting(enabled bool, ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = time.Minute
+	}
+	goroutineStatsMu.Lock()
+	defer goroutineStatsMu.Unlock()
+
+	clear(goroutineStats)
+	goroutineStatsTTL = ttl
+	goroutineStatsSwept = time.Now()
+	goroutineAccounting.Store(enabled)
+}
+
+// TopYielders returns the accounting of up to n goroutines, those that spent the most time
+// yielding and waiting first. It returns nil unless SetGoroutineAccounting is enabled.
+func TopYielders(n int) []GoroutineStats {
+	if !goroutineAccounting.Load() || n <= 0 {
+		return nil
+	}
+
+	goroutineStatsMu.Lock()
+	evictIdleGoroutinesLocked(time.Now())
+	all := make([]GoroutineStats, 0, len(goroutineStats))
+	for _, s := range goroutineStats {
+		all = append(all, *s)
+	}
+	goroutineStatsMu.Unlock()
+
+	slices.SortFunc(all, func(a, b GoroutineStats) int {
+		return cmp.Compare(b.BlockedTime, a.BlockedTime)
+	})
+	return all[:min(n, len(all))]
+}
+
+// accountGoroutine adds a yield or a wait of length d to the current goroutine's entry.
+func accountGoroutine(wait bool, d time.Duration) {
+	id := getGoroutineID()
+	now := time.Now()
+
+	goroutineStatsMu.Lock()
+	defer goroutineStatsMu.Unlock()
+
+	s := goroutineStats[id]
+	if s == nil {
+		s = &GoroutineStats{GoroutineID: id}
+		goroutineStats[id] = s
+	}
+	if wait {
+		s.Waits++
+	} else {
+		s.Yields++
+	}
+	s.BlockedTime += d
+	s.LastSeen = now
+
+	if now.Sub(goroutineStatsSwept) >= goroutineStatsTTL {
+		evictIdleGoroutinesLocked(now)
+	}
+}
+
+// evictIdleGoroutinesLocked removes entries idle for longer than the TTL.
+// goroutineStatsMu must be held.
+func evictIdleGoroutinesLocked(now time.Time) {
+	goroutineStatsSwept = now
+	for id, s := range goroutineStats {
+		if now.Sub(s.LastSeen) > goroutineStatsTTL {
+			delete(goroutineStats, id)
+		}
+	}
+}
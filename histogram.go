@@ -0,0 +1,117 @@
+package yieldpoint
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// histogramBuckets is the number of histogram buckets: one below 1µs, one per power of two
+// of microseconds up to 2^24µs (about 16.8s), and one for everything longer
+const histogramBuckets = 26
+
+// waitHistogram counts wait completions and yields per bucket
+var waitHistogram [histogramBuckets]atomic.Uint64
+
+// HistogramSnapshot is a copy of the duration histogram. Bucket i counts durations below
+// Bounds[i] and at least Bounds[i-1]; the last bound is math.MaxInt64 and catches the rest.
+type HistogramSnapshot struct {
+	Bounds []time.Duration
+	Counts []uint64
+}
+
+// Histogram returns a snapshot of the durations of completed waits in the WaitIfActive family
+// and of yields performed by the MaybeYield family. Buckets are log-spaced, doubling from 1µs.
+// ResetStats clears it.
+func Histogram() HistogramSnapshot {
+	s := HistogramSnapshot{
+		Bounds: histogramBounds(),
+		Counts: make([]uint64, histogramBuckets),
+	}
+	for i := range waitHistogram {
+		s.Counts[i] = waitHistogram[i].Load()
+	}
+	return s
+}
+
+// Total returns the number of durations in the snapshot.
+func (s HistogramSnapshot) Total() uint64 {
+	var n uint64
+	for _, c := range s.Counts {
+		n += c
+	}
+	return n
+}
+
+// Quantile returns an estimate of the q-quantile, for q in [0, 1], interpolating linearly
+// inside the bucket that contains it. It returns zero for an empty snapshot, and the lower
+// bound of the last bucket for quantiles that fall in it.
+func (s HistogramSnapshot) Quantile(q float64) time.Duration {
+	total := s.Total()
+	if total == 0 {
+		return 0
+	}
+	q = min(max(q, 0), 1)
+	rank := q * float64(total)
+
+	var seen float64
+	for i, c := range s.Counts {
+		if c == 0 || seen+float64(c) < rank {
+			seen += float64(c)
+			continue
+		}
+		var lo time.Duration
+		if i > 0 {
+			lo = s.Bounds[i-1]
+		}
+		if i == len(s.Counts)-1 {
+			return lo
+		}
+		frac := (rank - seen) / float64(c)
+		return lo + time.Duration(frac*float64(s.Bounds[i]-lo))
+	}
+	return s.Bounds[len(s.Bounds)-2]
+}
+
+// Merge returns the bucket-wise sum of s and other, which must come from Histogram.
+func (s HistogramSnapshot) Merge(other HistogramSnapshot) HistogramSnapshot {
+	m := HistogramSnapshot{
+		Bounds: histogramBounds(),
+		Counts: make([]uint64, histogramBuckets),
+	}
+	for i := range m.Counts {
+		if i < len(s.Counts) {
+			m.Counts[i] += s.Counts[i]
+		}
+		if i < len(other.Counts) {
+			m.Counts[i] += other.Counts[i]
+		}
+	}
+	return m
+}
+
+// histogramBounds returns the upper bound of every bucket.
+func histogramBounds() []time.Duration {
+	b := make([]time.Duration, histogramBuckets)
+	for i := range histogramBuckets - 1 {
+		b[i] = time.Microsecond << i
+	}
+	b[histogramBuckets-1] = time.Duration(1<<63 - 1)
+	return b
+}
+
+// observeDuration adds d to the histogram without allocating.
+func observeDuration(d time.Duration) {
+	i := 0
+	if d >= time.Microsecond {
+		i = min(bits.Len64(uint64(d/time.Microsecond)), histogramBuckets-1)
+	}
+	waitHistogram[i].Add(1)
+}
+
+// resetHistogram clears every bucket.
+func resetHistogram() {
+	for i := range waitHistogram {
+		waitHistogram[i].Store(0)
+	}
+}
@@ -0,0 +1,153 @@
+package yieldpoint
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// JSONTracer writes trace events to an io.Writer as newline-delimited JSON.
+// Install it with AddTraceFunc(t.Trace) or SetTraceFunc(t.Trace).
+// Write errors never panic; they are counted and available from ErrorCount and LastError.
+type JSONTracer struct {
+	mu  sync.Mutex
+	w   io.Writer
+	buf *bufio.Writer
+	err error
+
+	errors atomic.Uint64
+	ticker *time.Ticker
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// jsonEvent is the wire format of a YieldEvent
+type jsonEvent struct {
+	Timestamp      string `json:"timestamp"`
+	GoroutineID    uint64 `json:"goroutine_id"`
+	Reason         string `json:"reason"`
+	DurationNanos  int64  `json:"duration_ns"`
+	CallerFile     string `json:"caller_file,omitempty"`
+	CallerLine     int    `json:"caller_line,omitempty"`
+	CallerFunction string `json:"caller_function,omitempty"`
+	Stack          string `json:"stack,omitempty"`
+	Wakeups        int    `json:"wakeups,omitempty"`
+	SpinStage      string `json:"spin_stage,omitempty"`
+	Generation     uint64 `json:"generation,omitempty"`
+}
+
+// NewJSONTracer returns a JSONTracer that writes each event to w as it is emitted.
+func NewJSONTracer(w io.Writer) *JSONTracer {
+	return &JSONTracer{w: w}
+}
+
+// NewBufferedJSONTracer returns a JSONTracer that buffers events and writes them to w every
+// flushEvery, or sooner when the buffer fills. Close must be called to stop the flush timer
+// and write the remaining events. A non-positive flushEvery only flushes on a full buffer, Flush and Close.
+func NewBufferedJSONTracer(w io.Writer, flushEvery time.Duration) *JSONTracer {
+	t := &JSONTracer{w: w, buf: bufio.NewWriter(w)}
+	if flushEvery > 0 {
+		t.ticker = time.NewTicker(flushEvery)
+		t.stop = make(chan struct{})
+		t.done = make(chan struct{})
+		go t.flushLoop()
+	}
+	return t
+}
+
+// Trace writes e as a single line of JSON.
+func (t *JSONTracer) Trace(e YieldEvent) {
+	line, err := json.Marshal(jsonEvent{
+		Timestamp:      e.Timestamp.Format(time.RFC3339Nano),
+		GoroutineID:    e.GoroutineID,
+		Reason:         e.Reason.String(),
+		DurationNanos:  int64(e.Duration),
+		CallerFile:     e.CallerFile,
+		CallerLine:     e.CallerLine,
+		CallerFunction: e.CallerFunction,
+		Stack:          string(e.Stack),
+		Wakeups:        e.Wakeups,
+		SpinStage:      e.SpinStage.String(),
+		Generation:     e.Generation,
+	})
+	line = append(line, '\n')
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err == nil {
+		if t.buf != nil {
+			_, err = t.buf.Write(line)
+		} else {
+			_, err = t.w.Write(line)
+		}
+	}
+	t.recordLocked(err)
+}
+
+// Flush writes any buffered events to the underlying writer.
+func (t *JSONTracer) Flush() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.flushLocked()
+}
+
+// Close stops the flush timer, if any, and flushes the buffered events.
+func (t *JSONTracer) Close() error {
+	if t.ticker != nil {
+		t.ticker.Stop()
+		close(t.stop)
+		<-t.done
+		t.ticker = nil
+	}
+	return t.Flush()
+}
+
+// ErrorCount returns the number of events that could not be encoded or written.
+func (t *JSONTracer) ErrorCount() uint64 {
+	return t.errors.Load()
+}
+
+// LastError returns the most recent encoding or write error, or nil if there has been none.
+func (t *JSONTracer) LastError() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+// flushLoop flushes the buffer on every tick until Close.
+func (t *JSONTracer) flushLoop() {
+	defer close(t.done)
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-t.ticker.C:
+			_ = t.Flush()
+		}
+	}
+}
+
+// flushLocked flushes the buffer, if any. t.mu must be held.
+func (t *JSONTracer) flushLocked() error {
+	if t.buf == nil {
+		return nil
+	}
+	err := t.buf.Flush()
+	if err != nil {
+		// A failed bufio.Writer keeps returning the same error, so start over with a fresh one.
+		t.buf = bufio.NewWriter(t.w)
+	}
+	t.recordLocked(err)
+	return err
+}
+
+// recordLocked counts err, if any. t.mu must be held.
+func (t *JSONTracer) recordLocked(err error) {
+	if err != nil {
+		t.errors.Add(1)
+		t.err = err
+	}
+}
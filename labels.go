@@ -0,0 +1,84 @@
+package yieldpoint
+
+import (
+	"maps"
+	"sync"
+)
+
+// labeledSection tracks one open section entered with EnterHighPriorityLabeled
+type labeledSection struct {
+	// barriers are the barriers still waiting for this section to exit
+	barriers []*sectionBarrier
+}
+
+// sectionBarrier is closed once every section it captured has exited
+type sectionBarrier struct {
+	remaining int
+	ch        chan struct{}
+}
+
+var (
+	// labelMu guards activeLabels, openSections and the barriers attached to them
+	labelMu sync.Mutex
+	// activeLabels counts the active labeled sections per label
+	activeLabels = make(map[string]int)
+	// openSections holds every active labeled section
+	openSections = make(map[*labeledSection]struct{})
+)
+
+// EnterHighPriorityLabeled enters a high-priority section tagged with label and returns
+// the func that exits it. While the section is active, label is counted in ActiveLabels
+// and the section is tracked by HighPriorityBarrier. Calling release more than once has no effect.
+func EnterHighPriorityLabeled(label string) (release func()) {
+	s := &labeledSection{}
+	labelMu.Lock()
+	activeLabels[label]++
+	openSections[s] = struct{}{}
+	labelMu.Unlock()
+	EnterHighPriority()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			labelMu.Lock()
+			if activeLabels[label]--; activeLabels[label] == 0 {
+				delete(activeLabels, label)
+			}
+			delete(openSections, s)
+			for _, b := range s.barriers {
+				if b.remaining--; b.remaining == 0 {
+					close(b.ch)
+				}
+			}
+			labelMu.Unlock()
+			ExitHighPriority()
+		})
+	}
+}
+
+// ActiveLabels returns the number of active labeled sections per label.
+// Sections entered with EnterHighPriority are not included.
+// The returned map is a copy and may be modified by the caller.
+func ActiveLabels() map[string]int {
+	labelMu.Lock()
+	defer labelMu.Unlock()
+	return maps.Clone(activeLabels)
+}
+
+// HighPriorityBarrier returns a channel that is closed once every section open at the time
+// of the call has exited, regardless of sections entered afterwards.
+// Only sections entered with EnterHighPriorityLabeled can be told apart, so sections entered
+// with EnterHighPriority are not waited for; use WaitIfActive to wait for those.
+func HighPriorityBarrier() <-chan struct{} {
+	labelMu.Lock()
+	defer labelMu.Unlock()
+
+	if len(openSections) == 0 {
+		return closedCh
+	}
+	b := &sectionBarrier{remaining: len(openSections), ch: make(chan struct{})}
+	for s := range openSections {
+		s.barriers = append(s.barriers, b)
+	}
+	return b.ch
+}
@@ -0,0 +1,36 @@
+package yieldpoint
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// YieldLimiter caps how often a single call site actually yields.
+// It is safe for concurrent use by multiple goroutines sharing the call site.
+type YieldLimiter struct {
+	minInterval time.Duration
+	last        atomic.Int64
+}
+
+// NewLimiter returns a YieldLimiter that performs at most one real yield per minInterval.
+func NewLimiter(minInterval time.Duration) *YieldLimiter {
+	return &YieldLimiter{minInterval: minInterval}
+}
+
+// MaybeYield yields like the package-level MaybeYield, unless another yield through
+// this limiter happened less than minInterval ago, in which case it returns immediately.
+func (l *YieldLimiter) MaybeYield() {
+	if HighPriorityCount.Load() == 0 {
+		return
+	}
+
+	now := time.Now().UnixNano()
+	last := l.last.Load()
+	if now-last < int64(l.minInterval) {
+		return
+	}
+	if !l.last.CompareAndSwap(last, now) {
+		return
+	}
+	MaybeYield()
+}
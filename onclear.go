@@ -0,0 +1,64 @@
+package yieldpoint
+
+import "sync/atomic"
+
+// States of a clearCallback
+const (
+	callbackPending int32 = iota
+	callbackCancelled
+	callbackFired
+)
+
+// clearCallback is a function registered with OnClear
+type clearCallback struct {
+	fn      func()
+	state   atomic.Int32
+	started chan struct{}
+}
+
+// clearCallbacks holds the callbacks waiting for the next transition to zero; it is guarded by Mu
+var clearCallbacks map[*clearCallback]struct{}
+
+// OnClear arranges for fn to be called exactly once when no high-priority sections are active.
+// If none are active, fn runs immediately on the caller's goroutine; otherwise it runs on a
+// dispatch goroutine after the last section exits. The returned cancel unregisters fn;
+// once cancel returns, fn is guaranteed not to start. Calling cancel more than once is safe.
+func OnClear(fn func()) (cancel func()) {
+	Mu.Lock()
+	if HighPriorityCount.Load() == 0 {
+		Mu.Unlock()
+		fn()
+		return func() {}
+	}
+
+	cb := &clearCallback{fn: fn, started: make(chan struct{})}
+	if clearCallbacks == nil {
+		clearCallbacks = make(map[*clearCallback]struct{})
+	}
+	clearCallbacks[cb] = struct{}{}
+	Mu.Unlock()
+
+	return func() {
+		if cb.state.CompareAndSwap(callbackPending, callbackCancelled) {
+			Mu.Lock()
+			delete(clearCallbacks, cb)
+			Mu.Unlock()
+			return
+		}
+		if cb.state.Load() == callbackFired {
+			// The dispatcher won the race; wait until fn has started so it cannot start after we return.
+			<-cb.started
+		}
+	}
+}
+
+// dispatchClearCallbacks runs every callback that has not been cancelled.
+func dispatchClearCallbacks(cbs map[*clearCallback]struct{}) {
+	for cb := range cbs {
+		if !cb.state.CompareAndSwap(callbackPending, callbackFired) {
+			continue
+		}
+		close(cb.started)
+		cb.fn()
+	}
+}
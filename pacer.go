@@ -0,0 +1,68 @@
+package yieldpoint
+
+import "time"
+
+// maxPacerStride bounds how many ticks a Pacer lets pass between yield checks
+const maxPacerStride = 1 << 20
+
+// YieldEvery yields like MaybeYield when i is a multiple of n, and does nothing otherwise.
+// Values of n below 2 check on every call.
+func YieldEvery(i, n int) {
+	if n <= 1 || i%n == 0 {
+		MaybeYield()
+	}
+}
+
+// Pacer spaces out yield checks in a loop, tuning the stride so that checking costs
+// no more than a fixed fraction of the loop's running time.
+// A Pacer is not safe for concurrent use; give each goroutine its own.
+type Pacer struct {
+	fraction float64
+	stride   int
+	n        int
+	last     time.Time
+}
+
+// NewPacer returns a Pacer that keeps the cost of yield checks below fraction of the loop time.
+// Values outside (0, 1) fall back to 1%.
+func NewPacer(fraction float64) *Pacer {
+	if fraction <= 0 || fraction >= 1 {
+		fraction = 0.01
+	}
+	return &Pacer{fraction: fraction, stride: 1, last: time.Now()}
+}
+
+// Tick counts one loop iteration and yields when a check is due and high priority is active.
+// Checks made while no section is active are timed to adjust the stride.
+func (p *Pacer) Tick() {
+	p.n++
+	if p.n < p.stride {
+		return
+	}
+	p.n = 0
+
+	if HighPriorityCount.Load() > 0 {
+		MaybeYield()
+		p.last = time.Now()
+		return
+	}
+
+	start := time.Now()
+	MaybeYield()
+	end := time.Now()
+
+	cost := float64(end.Sub(start))
+	budget := p.fraction * float64(start.Sub(p.last))
+	switch {
+	case cost > budget && p.stride < maxPacerStride:
+		p.stride *= 2
+	case cost < budget/4 && p.stride > 1:
+		p.stride /= 2
+	}
+	p.last = end
+}
+
+// Stride returns the number of ticks between yield checks the Pacer currently uses.
+func (p *Pacer) Stride() int {
+	return p.stride
+}
@@ -0,0 +1,85 @@
+package yieldpoint
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// paused is set between Pause and Resume; it keeps the yield fast path to a single load
+var paused atomic.Bool
+
+// pauseCh is non-nil while paused and is closed by Resume; it is guarded by Mu
+var pauseCh chan struct{}
+
+// Pause makes goroutines block at their yield points until Resume is called.
+// MaybeYield, WaitIfActive, WaitIfActiveFast and their context variants all block while paused;
+// MaybeYieldNonBlocking does not. Pausing an already paused or shut down package has no effect.
+func Pause() {
+	Mu.Lock()
+	if pauseCh == nil && !shutdown.Load() {
+		pauseCh = make(chan struct{})
+		paused.Store(true)
+	}
+	Mu.Unlock()
+}
+
+// Resume releases goroutines blocked by Pause. Goroutines in WaitIfActive keep waiting
+// while high-priority sections are still active. Resuming when not paused has no effect.
+func Resume() {
+	Mu.Lock()
+	if pauseCh != nil {
+		close(pauseCh)
+		pauseCh = nil
+		paused.Store(false)
+	}
+	Mu.Unlock()
+}
+
+// IsPaused reports whether the package is currently paused.
+func IsPaused() bool {
+	return paused.Load()
+}
+
+// resumedChan returns a channel that is closed once the package is not paused.
+func resumedChan() <-chan struct{} {
+	Mu.Lock()
+	defer Mu.Unlock()
+	if pauseCh == nil {
+		return closedCh
+	}
+	return pauseCh
+}
+
+// waitWhilePaused blocks until Resume is called.
+func waitWhilePaused() {
+	if !paused.Load() || holdsCeiling() {
+		return
+	}
+
+	traceYieldEvent(ReasonPausedAtYieldPoint, 0)
+	start := time.Now()
+	for paused.Load() {
+		<-resumedChan()
+	}
+	traceYieldEvent(ReasonResumed, time.Since(start))
+}
+
+// waitWhilePausedContext blocks until Resume is called or ctx is done.
+func waitWhilePausedContext(ctx context.Context) error {
+	if !paused.Load() || holdsCeiling() {
+		return nil
+	}
+
+	traceYieldEvent(ReasonPausedAtYieldPoint, 0)
+	start := time.Now()
+	for paused.Load() {
+		select {
+		case <-ctx.Done():
+			return contextError(ctx)
+		case <-resumedChan():
+		}
+	}
+	traceYieldEvent(ReasonResumed, time.Since(start))
+	return nil
+}
@@ -0,0 +1,38 @@
+package yieldpoint
+
+import (
+	"context"
+	"runtime/pprof"
+	"sync/atomic"
+	"time"
+)
+
+// waitProfileLabels is set by SetWaitProfileLabels
+var waitProfileLabels atomic.Bool
+
+// DoHighPriority runs fn inside a high-priority section, with the pprof label
+// yieldpoint_priority=high added to ctx and to the current goroutine for the duration,
+// so CPU and goroutine profiles can tell its samples apart. The section is exited and
+// the goroutine's labels are restored to those of ctx even if fn panics.
+func DoHighPriority(ctx context.Context, fn func(ctx context.Context)) {
+	EnterHighPriority()
+	defer ExitHighPriority()
+	pprof.Do(ctx, pprof.Labels("yieldpoint_priority", "high"), fn)
+}
+
+// SetWaitProfileLabels enables or disables labeling goroutines blocked in WaitIfActiveWithContext
+// and WaitIfActiveWithContextTimed with the pprof label yieldpoint_state=waiting, so they stand out
+// in goroutine profiles. Afterwards the goroutine's labels are set to those of the context, so ctx
+// should carry them. It is off by default because applying labels allocates on every blocking wait.
+// WaitIfActive and WaitIfActiveFast have no context to restore labels from and are never labeled.
+func SetWaitProfileLabels(enabled bool) {
+	waitProfileLabels.Store(enabled)
+}
+
+// waitIfActiveContextLabeled runs waitIfActiveContext under the waiting pprof label.
+func waitIfActiveContextLabeled(ctx context.Context, start time.Time) (d time.Duration, handoff *queuedWaiter, err error) {
+	pprof.Do(ctx, pprof.Labels("yieldpoint_state", "waiting"), func(ctx context.Context) {
+		d, handoff, err = waitIfActiveContext(ctx, start)
+	})
+	return d, handoff, err
+}
@@ -0,0 +1,92 @@
+package yieldpoint
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Worker is a goroutine registered to take part in quiescence barriers.
+// Its yield methods mark it as parked while it is paused for a high-priority section.
+type Worker struct {
+	parked atomic.Bool
+}
+
+// workersMu guards workers
+var workersMu sync.Mutex
+
+// workers is the set of registered workers
+var workers = make(map[*Worker]struct{})
+
+// Register adds a worker that AwaitQuiescence will wait for.
+// The worker must call Unregister when it stops taking part.
+func Register() *Worker {
+	w := &Worker{}
+	workersMu.Lock()
+	workers[w] = struct{}{}
+	workersMu.Unlock()
+	return w
+}
+
+// Unregister removes the worker so AwaitQuiescence no longer waits for it.
+func (w *Worker) Unregister() {
+	workersMu.Lock()
+	delete(workers, w)
+	workersMu.Unlock()
+}
+
+// MaybeYield pauses the worker at this yield point while any high-priority sections are active
+// or the package is paused. Unlike the package-level MaybeYield it stays parked until the
+// sections end, so that the high-priority side can rely on the worker having stopped.
+func (w *Worker) MaybeYield() {
+	if HighPriorityCount.Load() > 0 || paused.Load() {
+		w.WaitIfActive()
+	}
+}
+
+// WaitIfActive blocks like the package-level WaitIfActive, marking the worker as parked meanwhile.
+// A call that finds nothing to wait for returns without ever marking the worker as parked.
+func (w *Worker) WaitIfActive() {
+	if HighPriorityCount.Load() == 0 && !paused.Load() {
+		return
+	}
+	w.parked.Store(true)
+	defer w.parked.Store(false)
+	WaitIfActive()
+}
+
+// AwaitQuiescence blocks until every registered worker is parked at a yield point.
+// It is meant to be called from inside a high-priority section. Workers that never reach
+// a yield point keep it blocked, so ctx should carry a deadline.
+func AwaitQuiescence(ctx context.Context) error {
+	if quiescent() {
+		return nil
+	}
+
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return contextError(ctx)
+		case <-ticker.C:
+			if quiescent() {
+				return nil
+			}
+		}
+	}
+}
+
+// quiescent reports whether every registered worker is parked.
+func quiescent() bool {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	for w := range workers {
+		if !w.parked.Load() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+package yieldpoint
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Recorder keeps the most recent trace events in a fixed-size ring for postmortems.
+// Install it with AddTraceFunc(r.Record) or SetTraceFunc(r.Record).
+// It is safe for concurrent use, including snapshots taken while events are recorded.
+type Recorder struct {
+	mu   sync.Mutex
+	buf  []YieldEvent
+	next int
+	full bool
+}
+
+// NewRecorder returns a Recorder that keeps the last capacity events.
+// Values below 1 are treated as 1.
+func NewRecorder(capacity int) *Recorder {
+	return &Recorder{buf: make([]YieldEvent, max(capacity, 1))}
+}
+
+// Record stores e, overwriting the oldest event once the ring is full.
+// It does not allocate.
+func (r *Recorder) Record(e YieldEvent) {
+	r.mu.Lock()
+	r.buf[r.next] = e
+	r.next++
+	if r.next == len(r.buf) {
+		r.next = 0
+		r.full = true
+	}
+	r.mu.Unlock()
+}
+
+// Snapshot returns a copy of the recorded events, oldest first.
+func (r *Recorder) Snapshot() []YieldEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.full {
+		return append([]YieldEvent(nil), r.buf[:r.next]...)
+	}
+	out := make([]YieldEvent, 0, len(r.buf))
+	out = append(out, r.buf[r.next:]...)
+	return append(out, r.buf[:r.next]...)
+}
+
+// Dump writes the recorded events to w, oldest first, one per line.
+func (r *Recorder) Dump(w io.Writer) error {
+	for _, e := range r.Snapshot() {
+		line := fmt.Sprintf("%s goroutine=%d reason=%s duration=%s",
+			e.Timestamp.Format(time.RFC3339Nano), e.GoroutineID, e.Reason, e.Duration)
+		if e.CallerFile != "" {
+			line += fmt.Sprintf(" caller=%s:%d", e.CallerFile, e.CallerLine)
+		}
+		if e.Wakeups != 0 {
+			line += fmt.Sprintf(" wakeups=%d", e.Wakeups)
+		}
+		if e.SpinStage != SpinStageNone {
+			line += " spin_stage=" + e.SpinStage.String()
+		}
+		if e.Generation != 0 {
+			line += fmt.Sprintf(" generation=%d", e.Generation)
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+		if len(e.Stack) > 0 {
+			if _, err := w.Write(e.Stack); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package yieldpoint
+
+import (
+	"context"
+	"runtime/trace"
+	"sync/atomic"
+)
+
+// sectionTask is the runtime/trace task covering one period of high-priority activity
+type sectionTask struct {
+	ctx  context.Context
+	task *trace.Task
+}
+
+var (
+	// runtimeTraceOn is set by EnableRuntimeTrace
+	runtimeTraceOn atomic.Bool
+	// activeTask is the task of the current active period, or nil; it is only changed under activeMu
+	activeTask atomic.Pointer[sectionTask]
+)
+
+// EnableRuntimeTrace makes the package annotate Go execution traces, as captured with
+// runtime/trace.Start or net/http/pprof: each period during which high priority is active becomes
+// a "yieldpoint.HighPriority" task, enters and exits are logged under the "yieldpoint" category,
+// and yields and waits are marked as "yieldpoint.MaybeYield" and "yieldpoint.WaitIfActive" regions.
+// Annotations are skipped while it is off, the default, or while no execution trace is running.
+func EnableRuntimeTrace(enabled bool) {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+
+	runtimeTraceOn.Store(enabled)
+	if !enabled {
+		endSectionTask()
+	}
+}
+
+// runtimeTracing reports whether annotations should be emitted.
+func runtimeTracing() bool {
+	return runtimeTraceOn.Load() && trace.IsEnabled()
+}
+
+// traceContext returns the context of the active task, or the background context.
+func traceContext() context.Context {
+	if t := activeTask.Load(); t != nil {
+		return t.ctx
+	}
+	return context.Background()
+}
+
+// startSectionTask begins the task of a new active period. activeMu must be held.
+func startSectionTask() {
+	if !runtimeTracing() {
+		return
+	}
+	ctx, task := trace.NewTask(context.Background(), "yieldpoint.HighPriority")
+	if old := activeTask.Swap(&sectionTask{ctx: ctx, task: task}); old != nil {
+		old.task.End()
+	}
+}
+
+// endSectionTask ends the task of the current active period, if any. activeMu must be held.
+func endSectionTask() {
+	if t := activeTask.Swap(nil); t != nil {
+		t.task.End()
+	}
+}
+
+// runtimeTraceLog logs msg under the yieldpoint category of the active task.
+func runtimeTraceLog(msg string) {
+	if runtimeTracing() {
+		trace.Log(traceContext(), "yieldpoint", msg)
+	}
+}
+
+// startRuntimeRegion starts a region named name, or returns nil when annotations are off.
+func startRuntimeRegion(name string) *trace.Region {
+	if !runtimeTracing() {
+		return nil
+	}
+	return trace.StartRegion(traceContext(), name)
+}
+
+// endRuntimeRegion ends r if it was started.
+func endRuntimeRegion(r *trace.Region) {
+	if r != nil {
+		r.End()
+	}
+}
@@ -0,0 +1,61 @@
+package yieldpoint
+
+import "sync"
+
+// PriorityRWMutex is a sync.RWMutex whose writers run as high-priority sections.
+// While a writer holds or is waiting for the lock, readers calling RLock and background
+// work calling MaybeYield yield before proceeding.
+// The zero value is an unlocked mutex, and a PriorityRWMutex must not be copied after first use.
+type PriorityRWMutex struct {
+	rw sync.RWMutex
+}
+
+// Lock enters high priority and then locks m for writing.
+// The section stays active until Unlock.
+func (m *PriorityRWMutex) Lock() {
+	EnterHighPriority()
+	m.rw.Lock()
+}
+
+// TryLock tries to lock m for writing, entering high priority only on success.
+// A failed attempt has no effect on the package: no section is entered, traced or counted.
+func (m *PriorityRWMutex) TryLock() bool {
+	if !m.rw.TryLock() {
+		return false
+	}
+	EnterHighPriority()
+	return true
+}
+
+// Unlock unlocks m for writing and exits the high-priority section entered by Lock.
+func (m *PriorityRWMutex) Unlock() {
+	m.rw.Unlock()
+	ExitHighPriority()
+}
+
+// RLock yields if high priority is active and then locks m for reading.
+func (m *PriorityRWMutex) RLock() {
+	MaybeYield()
+	m.rw.RLock()
+}
+
+// TryRLock tries to lock m for reading without yielding.
+func (m *PriorityRWMutex) TryRLock() bool {
+	return m.rw.TryRLock()
+}
+
+// RUnlock undoes a single RLock call.
+func (m *PriorityRWMutex) RUnlock() {
+	m.rw.RUnlock()
+}
+
+// RLocker returns a sync.Locker that calls m.RLock and m.RUnlock.
+func (m *PriorityRWMutex) RLocker() sync.Locker {
+	return (*rlocker)(m)
+}
+
+// rlocker adapts the read side of a PriorityRWMutex to sync.Locker
+type rlocker PriorityRWMutex
+
+func (r *rlocker) Lock()   { (*PriorityRWMutex)(r).RLock() }
+func (r *rlocker) Unlock() { (*PriorityRWMutex)(r).RUnlock() }
@@ -0,0 +1,129 @@
+package yieldpoint
+
+import (
+	"math"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// samplingMu serializes changes to the sampling configuration
+	samplingMu sync.Mutex
+	// samplingActive is set while a sampling probability below 1 or a rate limit is configured
+	samplingActive atomic.Bool
+	// sampleProb holds the float64 bits of the probability of keeping an event
+	sampleProb atomic.Uint64
+	// sampleRateLimit is the maximum number of sampled events per second, or 0 for no limit
+	sampleRateLimit atomic.Int64
+	// sampleRateSecond is the Unix second the rate limit is currently counting
+	sampleRateSecond atomic.Int64
+	// sampleRateCount is the number of events kept during sampleRateSecond
+	sampleRateCount atomic.Int64
+	// sampleConsidered and sampleKept count the non-exempt events seen and delivered while sampling
+	sampleConsidered, sampleKept atomic.Uint64
+)
+
+// samplingExempt is the set of reasons that are never sampled out
+var samplingExempt atomic.Pointer[map[Reason]struct{}]
+
+func init() {
+	sampleProb.Store(math.Float64bits(1))
+	SetTraceSamplingExempt(ReasonEnterHighPriority, ReasonExitHighPriority, ReasonWaitComplete, ReasonWaitCompleteFast,
+		ReasonDepthWaitComplete, ReasonActivationWaitComplete, ReasonQuietWaitComplete)
+}
+
+// SetTraceSampling keeps each trace event with probability prob and drops the rest before the
+// event is built. prob is clamped to [0, 1], and 1, the default, keeps every event.
+// Reasons selected with SetTraceSamplingExempt are always kept.
+func SetTraceSampling(prob float64) {
+	if math.IsNaN(prob) {
+		prob = 1
+	}
+	prob = min(max(prob, 0), 1)
+
+	samplingMu.Lock()
+	defer samplingMu.Unlock()
+	sampleProb.Store(math.Float64bits(prob))
+	updateSamplingLocked()
+}
+
+// SetTraceRateLimit caps the number of trace events delivered per second at approximately
+// maxPerSecond, applied after SetTraceSampling. A non-positive maxPerSecond, the default,
+// removes the cap. Reasons selected with SetTraceSamplingExempt are neither limited nor counted.
+func SetTraceRateLimit(maxPerSecond int) {
+	samplingMu.Lock()
+	defer samplingMu.Unlock()
+	sampleRateLimit.Store(int64(max(maxPerSecond, 0)))
+	updateSamplingLocked()
+}
+
+// SetTraceSamplingExempt selects the reasons that bypass SetTraceSampling and SetTraceRateLimit,
+// replacing the previous selection. By default enter, exit and wait-complete events are exempt,
+// since dropping them breaks accounting of sections and waits. Calling it with no reasons
+// subjects every event to sampling.
+func SetTraceSamplingExempt(reasons ...Reason) {
+	if len(reasons) == 0 {
+		samplingExempt.Store(nil)
+		return
+	}
+	set := make(map[Reason]struct{}, len(reasons))
+	for _, r := range reasons {
+		set[r] = struct{}{}
+	}
+	samplingExempt.Store(&set)
+}
+
+// TraceSampledFraction returns the fraction of non-exempt trace events delivered since sampling
+// was last configured, for rescaling counts derived from a sampled trace.
+// It returns 1 when sampling is off or no events have been seen.
+func TraceSampledFraction() float64 {
+	if !samplingActive.Load() {
+		return 1
+	}
+	considered := sampleConsidered.Load()
+	if considered == 0 {
+		return 1
+	}
+	return float64(sampleKept.Load()) / float64(considered)
+}
+
+// updateSamplingLocked recomputes samplingActive and restarts the sampled fraction.
+// samplingMu must be held.
+func updateSamplingLocked() {
+	sampleConsidered.Store(0)
+	sampleKept.Store(0)
+	samplingActive.Store(math.Float64frombits(sampleProb.Load()) < 1 || sampleRateLimit.Load() > 0)
+}
+
+// sampleTraceEvent reports whether an event with the given reason should be delivered.
+func sampleTraceEvent(reason Reason) bool {
+	if !samplingActive.Load() {
+		return true
+	}
+	if set := samplingExempt.Load(); set != nil {
+		if _, ok := (*set)[reason]; ok {
+			return true
+		}
+	}
+
+	sampleConsidered.Add(1)
+	if p := math.Float64frombits(sampleProb.Load()); p < 1 && rand.Float64() >= p {
+		return false
+	}
+	if limit := sampleRateLimit.Load(); limit > 0 && !allowTraceRate(limit) {
+		return false
+	}
+	sampleKept.Add(1)
+	return true
+}
+
+// allowTraceRate counts one event against the current second and reports whether it is within limit.
+func allowTraceRate(limit int64) bool {
+	sec := time.Now().Unix()
+	if cur := sampleRateSecond.Load(); cur != sec && sampleRateSecond.CompareAndSwap(cur, sec) {
+		sampleRateCount.Store(0)
+	}
+	return sampleRateCount.Add(1) <= limit
+}
@@ -0,0 +1,41 @@
+package yieldpoint
+
+import "sync/atomic"
+
+// shutdown is set once Shutdown has been called
+var shutdown atomic.Bool
+
+// shutdownCh is closed by Shutdown to cut short the staggered release of queued waiters;
+// it is guarded by Mu
+var shutdownCh = make(chan struct{})
+
+// Shutdown releases every goroutine blocked by the package, even if sections were never exited,
+// and makes all later yields and waits return immediately. Context-aware functions return
+// ErrShutdown from then on, and EnterHighPriority becomes a no-op. Calling it again has no effect.
+func Shutdown() {
+	if !shutdown.CompareAndSwap(false, true) {
+		return
+	}
+
+	Mu.Lock()
+	HighPriorityCount.Store(0)
+	activeWeight.Store(0)
+	markInactive()
+	close(shutdownCh)
+	signalClearLocked()
+	Mu.Unlock()
+
+	Resume()
+}
+
+// shutdownChan returns a channel that is closed once Shutdown has been called.
+func shutdownChan() <-chan struct{} {
+	Mu.Lock()
+	defer Mu.Unlock()
+	return shutdownCh
+}
+
+// IsShutdown reports whether Shutdown has been called.
+func IsShutdown() bool {
+	return shutdown.Load()
+}
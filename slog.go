@@ -0,0 +1,50 @@
+package yieldpoint
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+)
+
+// NewSlogTracer returns a trace func that logs each event to logger at level, with the
+// attributes seq, goroutine_id, reason and duration, plus the caller when SetTraceCallers is on,
+// and wakeups, spin_stage and generation when the event has them.
+// seq counts the events logged by this tracer. Events are skipped before any attribute is
+// built when logger is not enabled for level.
+func NewSlogTracer(logger *slog.Logger, level slog.Level) func(YieldEvent) {
+	var seq atomic.Uint64
+	return func(e YieldEvent) {
+		ctx := context.Background()
+		if !logger.Enabled(ctx, level) {
+			return
+		}
+		attrs := []slog.Attr{
+			slog.Uint64("seq", seq.Add(1)-1),
+			slog.Uint64("goroutine_id", e.GoroutineID),
+			slog.String("reason", e.Reason.String()),
+			slog.Duration("duration", e.Duration),
+		}
+		if e.CallerFile != "" {
+			attrs = append(attrs,
+				slog.String("caller_file", e.CallerFile),
+				slog.Int("caller_line", e.CallerLine),
+				slog.String("caller_function", e.CallerFunction))
+		}
+		if e.Wakeups != 0 {
+			attrs = append(attrs, slog.Int("wakeups", e.Wakeups))
+		}
+		if e.SpinStage != SpinStageNone {
+			attrs = append(attrs, slog.String("spin_stage", e.SpinStage.String()))
+		}
+		if e.Generation != 0 {
+			attrs = append(attrs, slog.Uint64("generation", e.Generation))
+		}
+		logger.LogAttrs(ctx, level, "yieldpoint", attrs...)
+	}
+}
+
+// TraceToSlog subscribes a NewSlogTracer logging to logger at slog.LevelDebug,
+// and returns the func that unsubscribes it.
+func TraceToSlog(logger *slog.Logger) (remove func()) {
+	return AddTraceFunc(NewSlogTracer(logger, slog.LevelDebug))
+}
@@ -0,0 +1,178 @@
+package yieldpoint
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// yieldCount counts the yields performed by the MaybeYield family
+	yieldCount atomic.Uint64
+	// waitCount and fastWaitCount count the blocking calls to the WaitIfActive family
+	waitCount, fastWaitCount atomic.Uint64
+	// canceledCount counts context-aware yields and waits that returned an error
+	canceledCount atomic.Uint64
+	// waitNanos is the total time spent blocked in the WaitIfActive family, in nanoseconds
+	waitNanos atomic.Int64
+	// maxWaitNanos is the longest single wait, in nanoseconds
+	maxWaitNanos atomic.Int64
+	// maxActiveNanos is the longest finished active period, in nanoseconds
+	maxActiveNanos atomic.Int64
+	// activeTimeBase is the ActiveTime at the last ResetStats
+	activeTimeBase atomic.Int64
+	// spinResolvedCount and spinFallbackCount count the spin phases of WaitIfActiveFast that saw the
+	// count drop to zero and those that gave up and blocked
+	spinResolvedCount, spinFallbackCount atomic.Uint64
+	// reasonCounts counts the events emitted for each of the package's reasons
+	reasonCounts [numBuiltinReasons]atomic.Uint64
+)
+
+// StatsSnapshot is a point-in-time copy of the package's statistics.
+// Counters and totals only grow between ResetStats calls.
+type StatsSnapshot struct {
+	// Yields is the number of yields performed by the MaybeYield family.
+	Yields uint64
+	// Waits is the number of calls that blocked to WaitIfActive, its context-aware and limited
+	// variants, WaitForDepthBelow, WaitForHighPriority, WaitForQuiet, MaybeYieldUntil and MaybeYieldBlocking.
+	Waits uint64
+	// FastWaits is the number of calls to WaitIfActiveFast that blocked or spun.
+	FastWaits uint64
+	// Canceled is the number of context-aware yields and waits that returned an error,
+	// and of WaitIfActiveLimited calls that gave up.
+	Canceled uint64
+
+	// WaitTime is the total time spent in Waits and FastWaits, and MaxWait the longest of them.
+	WaitTime time.Duration
+	MaxWait  time.Duration
+
+	// HoldTime is the total time during which at least one section was active, and MaxHold the
+	// longest finished such period. Overlapping sections count once.
+	HoldTime time.Duration
+	MaxHold  time.Duration
+
+	// Active and Waiters are the current number of active sections and blocked goroutines.
+	Active  int
+	Waiters int
+
+	// TraceDropped is the number of trace events lost by asynchronous delivery,
+	// and TraceSampledFraction the fraction of events kept by trace sampling.
+	TraceDropped         uint64
+	TraceSampledFraction float64
+
+	// ThrottleSleeps is the number of sleeps taken by the SetThrottle duty cycle,
+	// and ThrottleSleepTime the total time spent in them.
+	ThrottleSleeps    uint64
+	ThrottleSleepTime time.Duration
+
+	// SpinResolved and SpinFallbacks are the values returned by SpinStats.
+	SpinResolved  uint64
+	SpinFallbacks uint64
+
+	// ByReason counts the events emitted per Reason, whether or not a trace func is installed
+	// and before sampling. Reasons with no events are omitted.
+	ByReason map[Reason]uint64
+}
+
+// Stats returns a snapshot of the package's statistics since the process started or ResetStats was last called.
+func Stats() StatsSnapshot {
+	return StatsSnapshot{
+		Yields:               yieldCount.Load(),
+		Waits:                waitCount.Load(),
+		FastWaits:            fastWaitCount.Load(),
+		Canceled:             canceledCount.Load(),
+		WaitTime:             time.Duration(waitNanos.Load()),
+		MaxWait:              time.Duration(maxWaitNanos.Load()),
+		HoldTime:             max(ActiveTime()-time.Duration(activeTimeBase.Load()), 0),
+		MaxHold:              time.Duration(maxActiveNanos.Load()),
+		Active:               int(HighPriorityCount.Load()),
+		Waiters:              int(waiters.Load()),
+		TraceDropped:         traceDropped.Load(),
+		TraceSampledFraction: TraceSampledFraction(),
+		ThrottleSleeps:       throttleSleeps.Load(),
+		ThrottleSleepTime:    time.Duration(throttleSleepNanos.Load()),
+		SpinResolved:         spinResolvedCount.Load(),
+		SpinFallbacks:        spinFallbackCount.Load(),
+		ByReason:             reasonCountsSnapshot(),
+	}
+}
+
+// reasonCountsSnapshot returns the non-zero per-reason event counts.
+func reasonCountsSnapshot() map[Reason]uint64 {
+	m := make(map[Reason]uint64)
+	for i := range reasonCounts {
+		if n := reasonCounts[i].Load(); n > 0 {
+			m[Reason(i)] = n
+		}
+	}
+	return m
+}
+
+// countReason counts one event for reason.
+func countReason(reason Reason) {
+	if int(reason) < len(reasonCounts) {
+		reasonCounts[reason].Add(1)
+	}
+}
+
+// ResetStats sets all counters and totals reported by Stats back to zero.
+// The current gauges, Active and Waiters, are not affected.
+func ResetStats() {
+	yieldCount.Store(0)
+	waitCount.Store(0)
+	fastWaitCount.Store(0)
+	canceledCount.Store(0)
+	waitNanos.Store(0)
+	maxWaitNanos.Store(0)
+	maxActiveNanos.Store(0)
+	activeTimeBase.Store(int64(ActiveTime()))
+	traceDropped.Store(0)
+	resetHistogram()
+	spinResolvedCount.Store(0)
+	spinFallbackCount.Store(0)
+	throttleSleeps.Store(0)
+	throttleSleepNanos.Store(0)
+	throttleWindowNanos.Store(0)
+	for i := range reasonCounts {
+		reasonCounts[i].Store(0)
+	}
+}
+
+// SpinStats reports how often the spin phase of WaitIfActiveFast ended with no sections active
+// (spinResolved) versus giving up and blocking (fallback), for tuning SetSpinWaitIterations and
+// SetSpinBudget. Waits routed through SetWaitStrategy do not spin and are not counted.
+// ResetStats clears both counts.
+func SpinStats() (spinResolved, fallback uint64) {
+	return spinResolvedCount.Load(), spinFallbackCount.Load()
+}
+
+// recordWait counts one blocking wait of length d in counter and the wait totals.
+func recordWait(counter *atomic.Uint64, d time.Duration) {
+	counter.Add(1)
+	waitNanos.Add(int64(d))
+	storeMax(&maxWaitNanos, int64(d))
+	observeDuration(d)
+	if goroutineAccounting.Load() {
+		accountGoroutine(true, d)
+	}
+}
+
+// finishWait records a blocking wait of length d and traces its outcome: reason on
+// success, or ReasonWaitCanceled when err is not nil.
+func finishWait(reason Reason, d time.Duration, wakeups int, err error) {
+	recordWait(&waitCount, d)
+	if err != nil {
+		canceledCount.Add(1)
+		reason = ReasonWaitCanceled
+	}
+	traceWaitEvent(reason, d, wakeups)
+}
+
+// storeMax raises v to x if x is larger.
+func storeMax(v *atomic.Int64, x int64) {
+	for {
+		cur := v.Load()
+		if x <= cur || v.CompareAndSwap(cur, x) {
+			return
+		}
+	}
+}
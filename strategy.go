@@ -0,0 +1,136 @@
+package yieldpoint
+
+import (
+	"context"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// WaitStrategy decides how a waiting goroutine behaves while high-priority sections are active.
+// Next is called after each check that found a section active, with attempt counting from zero.
+// A zero sleep means runtime.Gosched, a positive sleep means time.Sleep, and block means
+// giving up on polling and blocking until the count drops to zero.
+type WaitStrategy interface {
+	Next(attempt int) (sleep time.Duration, block bool)
+}
+
+// strategyHolder wraps a WaitStrategy so it can be stored in an atomic.Pointer
+type strategyHolder struct {
+	s WaitStrategy
+}
+
+// waitStrategy is the strategy used by all waiting functions, or nil for their built-in behavior
+var waitStrategy atomic.Pointer[strategyHolder]
+
+// SetWaitStrategy routes WaitIfActive, WaitIfActiveFast and WaitIfActiveWithContext through s.
+// A nil s restores the built-in behavior of each function.
+func SetWaitStrategy(s WaitStrategy) {
+	if s == nil {
+		waitStrategy.Store(nil)
+		return
+	}
+	waitStrategy.Store(&strategyHolder{s: s})
+}
+
+// currentWaitStrategy returns the configured strategy, or nil if none is set.
+func currentWaitStrategy() WaitStrategy {
+	if h := waitStrategy.Load(); h != nil {
+		return h.s
+	}
+	return nil
+}
+
+// BlockImmediately blocks as soon as a section is found active, like WaitIfActive.
+type BlockImmediately struct{}
+
+// Next implements WaitStrategy.
+func (BlockImmediately) Next(int) (time.Duration, bool) {
+	return 0, true
+}
+
+// SpinThenBlock calls runtime.Gosched for Iterations checks before blocking, like WaitIfActiveFast.
+type SpinThenBlock struct {
+	Iterations int
+}
+
+// Next implements WaitStrategy.
+func (s SpinThenBlock) Next(attempt int) (time.Duration, bool) {
+	return 0, attempt >= s.Iterations
+}
+
+// BackoffStrategy sleeps between checks, starting at Initial and doubling up to Max.
+// After MaxAttempts sleeps it blocks; a non-positive MaxAttempts never blocks.
+type BackoffStrategy struct {
+	Initial     time.Duration
+	Max         time.Duration
+	MaxAttempts int
+}
+
+// Next implements WaitStrategy.
+func (s BackoffStrategy) Next(attempt int) (time.Duration, bool) {
+	if s.MaxAttempts > 0 && attempt >= s.MaxAttempts {
+		return 0, true
+	}
+	d := s.Initial
+	for range attempt {
+		if s.Max > 0 && d >= s.Max {
+			break
+		}
+		d *= 2
+	}
+	if s.Max > 0 {
+		d = min(d, s.Max)
+	}
+	return d, false
+}
+
+// waitWithStrategy blocks the current goroutine as directed by s until no sections are active.
+func waitWithStrategy(s WaitStrategy) {
+	for attempt := 0; HighPriorityCount.Load() > 0; attempt++ {
+		sleep, block := s.Next(attempt)
+		if block {
+			blockUntilClear()
+			return
+		}
+		if sleep > 0 {
+			time.Sleep(sleep)
+		} else {
+			runtime.Gosched()
+		}
+	}
+}
+
+// waitWithStrategyContext is the context-aware version of waitWithStrategy.
+func waitWithStrategyContext(ctx context.Context, s WaitStrategy) error {
+	for attempt := 0; HighPriorityCount.Load() > 0; attempt++ {
+		if ctx.Err() != nil {
+			return contextError(ctx)
+		}
+
+		sleep, block := s.Next(attempt)
+		if block {
+			for HighPriorityCount.Load() > 0 {
+				select {
+				case <-ctx.Done():
+					return contextError(ctx)
+				case <-clearedChan():
+				}
+			}
+			return nil
+		}
+		if sleep <= 0 {
+			runtime.Gosched()
+			continue
+		}
+
+		timer := time.NewTimer(sleep)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return contextError(ctx)
+		case <-timer.C:
+		}
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package yieldpoint
+
+import "sync/atomic"
+
+var (
+	// testMode replaces real yields with recorded intents
+	testMode atomic.Bool
+	// yieldIntents counts the yields skipped in test mode
+	yieldIntents atomic.Int64
+)
+
+// SetTestMode enables or disables test mode, in which the MaybeYield variants decide exactly as
+// usual but, instead of calling runtime.Gosched, the yield action or sleeping for SetThrottle,
+// only count the yield and return. Enabling it resets the count returned by YieldIntents.
+// It is meant for unit tests and is off by default.
+func SetTestMode(enabled bool) {
+	if enabled {
+		yieldIntents.Store(0)
+	}
+	testMode.Store(enabled)
+}
+
+// YieldIntents returns the number of yields skipped since test mode was last enabled.
+func YieldIntents() int {
+	return int(yieldIntents.Load())
+}
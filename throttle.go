@@ -0,0 +1,98 @@
+package yieldpoint
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// throttleConfig is the duty cycle MaybeYield applies while high priority is active
+type throttleConfig struct {
+	fraction float64
+	window   time.Duration
+	run      time.Duration
+}
+
+// throttle holds the active duty cycle, or nil when throttling is off
+var throttle atomic.Pointer[throttleConfig]
+
+var (
+	// throttleSleeps counts the sleeps taken by the duty cycle
+	throttleSleeps atomic.Uint64
+	// throttleSleepNanos is the total time spent in those sleeps, in nanoseconds
+	throttleSleepNanos atomic.Int64
+	// throttleWindowNanos is the total length of the windows those sleeps ended, in nanoseconds
+	throttleWindowNanos atomic.Int64
+)
+
+// SetThrottle makes MaybeYield and MaybeYieldWithContext apply a duty cycle while high-priority
+// sections are active instead of yielding on every call: in each window, callers run freely for
+// the first fraction of it and sleep through the rest. Windows are aligned to the wall clock, so
+// all goroutines share the same phase without any coordination. A fraction outside (0, 1) or
+// a non-positive window turns throttling off.
+//
+// Each sleep is counted in Stats and traced as ReasonThrottleSleep; ThrottleDutyCycle reports
+// the duty cycle achieved.
+func SetThrottle(fraction float64, window time.Duration) {
+	if fraction <= 0 || fraction >= 1 || window <= 0 {
+		throttle.Store(nil)
+		return
+	}
+	throttle.Store(&throttleConfig{
+		fraction: fraction,
+		window:   window,
+		run:      time.Duration(fraction * float64(window)),
+	})
+}
+
+// ThrottleDutyCycle returns the fraction configured by SetThrottle, or zero when throttling is
+// off, and the fraction of each window callers actually ran, averaged over the windows in which
+// they slept. achieved is above target when callers reach their yield points too rarely to stop
+// on time, and zero until a caller has slept. ResetStats clears the measurement.
+func ThrottleDutyCycle() (target, achieved float64) {
+	if t := throttle.Load(); t != nil {
+		target = t.fraction
+	}
+	if window := throttleWindowNanos.Load(); window > 0 {
+		achieved = max(1-float64(throttleSleepNanos.Load())/float64(window), 0)
+	}
+	return target, achieved
+}
+
+// throttled applies the duty cycle if throttling is on and reports whether it did.
+func throttled() bool {
+	t := throttle.Load()
+	if t == nil {
+		return false
+	}
+	_ = throttleSleep(context.Background(), t)
+	return true
+}
+
+// throttleSleep sleeps through the rest of the current window of t if its run phase is over,
+// returning early with ctx's error when ctx is done first.
+func throttleSleep(ctx context.Context, t *throttleConfig) error {
+	pos := time.Duration(time.Now().UnixNano() % int64(t.window))
+	if pos < t.run {
+		return nil
+	}
+	if testMode.Load() {
+		yieldIntents.Add(1)
+		return nil
+	}
+
+	start := time.Now()
+	timer := time.NewTimer(t.window - pos)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return contextError(ctx)
+	case <-timer.C:
+	}
+	d := time.Since(start)
+	throttleSleeps.Add(1)
+	throttleSleepNanos.Add(int64(d))
+	throttleWindowNanos.Add(int64(t.window))
+	traceYieldEvent(ReasonThrottleSleep, d)
+	return nil
+}
@@ -0,0 +1,479 @@
+package yieldpoint
+
+import (
+	"bytes"
+	"math"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reason identifies why a YieldEvent was emitted.
+// Its String method returns a stable snake_case name suitable for logs and dashboards.
+type Reason uint32
+
+// Reasons reported in YieldEvent.Reason.
+const (
+	// ReasonUnknown is the zero Reason and is never emitted by the package.
+	ReasonUnknown Reason = iota
+	// ReasonEnterHighPriority is emitted by every EnterHighPriority call.
+	ReasonEnterHighPriority
+	// ReasonExitHighPriority is emitted by every ExitHighPriority call.
+	ReasonExitHighPriority
+	// ReasonHighPriorityActive is emitted when a MaybeYield variant yields, with the time
+	// spent in runtime.Gosched or the action installed by SetYieldAction.
+	ReasonHighPriorityActive
+	// ReasonYieldSuppressed is emitted when MaybeYieldIf's predicate or the yield decider declines a yield,
+	// or a goroutine has used its SetYieldBudget.
+	ReasonYieldSuppressed
+	// ReasonYieldCanceled is emitted when MaybeYieldWithContext returns because its context is done.
+	ReasonYieldCanceled
+	// ReasonYieldUntilCleared is emitted when MaybeYieldUntil or MaybeYieldBlocking returns because sections ended.
+	ReasonYieldUntilCleared
+	// ReasonYieldUntilDeadline is emitted when MaybeYieldUntil or MaybeYieldBlocking gives up at its deadline.
+	ReasonYieldUntilDeadline
+	// ReasonWaitComplete is emitted when WaitIfActive, WaitIfActiveWithContext or WaitIfActiveLimited
+	// returns after blocking.
+	ReasonWaitComplete
+	// ReasonWaitCompleteFast is emitted when WaitIfActiveFast returns after spinning or blocking.
+	ReasonWaitCompleteFast
+	// ReasonWaitCanceled is emitted when a blocking wait gives up: a context-aware wait returning
+	// an error, or WaitIfActiveLimited returning ErrTooManyWakeups.
+	ReasonWaitCanceled
+	// ReasonPausedAtYieldPoint is emitted when a goroutine blocks at a yield point because of Pause.
+	ReasonPausedAtYieldPoint
+	// ReasonResumed is emitted when a goroutine blocked by Pause continues.
+	ReasonResumed
+	// ReasonWaitStart is emitted when a WaitIfActive variant, WaitForDepthBelow, WaitForHighPriority
+	// or WaitForQuiet is about to block. Its matching completion or ReasonWaitCanceled event
+	// carries the time spent blocked.
+	ReasonWaitStart
+	// ReasonDepthWaitComplete is emitted when WaitForDepthBelow or its context variant returns after blocking.
+	ReasonDepthWaitComplete
+	// ReasonActivationWaitComplete is emitted when WaitForHighPriority or its context variant
+	// returns after blocking.
+	ReasonActivationWaitComplete
+	// ReasonQuietWaitComplete is emitted when WaitForQuiet returns.
+	ReasonQuietWaitComplete
+	// ReasonThrottleSleep is emitted when a caller sleeps through the rest of a SetThrottle window,
+	// with the time it slept.
+	ReasonThrottleSleep
+	// ReasonSelfWaitDetected is emitted when a goroutine calls a WaitIfActive variant or WaitForQuiet
+	// while holding a section itself, as detected by SetGoroutineDepthTracking.
+	ReasonSelfWaitDetected
+
+	// numBuiltinReasons is the number of reasons defined by the package
+	numBuiltinReasons
+)
+
+// builtinReasonNames are the names of the package's own reasons, indexed by Reason
+var builtinReasonNames = []string{
+	ReasonUnknown:                "unknown",
+	ReasonEnterHighPriority:      "enter_high_priority",
+	ReasonExitHighPriority:       "exit_high_priority",
+	ReasonHighPriorityActive:     "high_priority_active",
+	ReasonYieldSuppressed:        "yield_suppressed",
+	ReasonYieldCanceled:          "yield_canceled",
+	ReasonYieldUntilCleared:      "yield_until_cleared",
+	ReasonYieldUntilDeadline:     "yield_until_deadline",
+	ReasonWaitComplete:           "wait_complete",
+	ReasonWaitCompleteFast:       "wait_complete_fast",
+	ReasonWaitCanceled:           "wait_canceled",
+	ReasonPausedAtYieldPoint:     "paused_at_yieldpoint",
+	ReasonResumed:                "resumed",
+	ReasonWaitStart:              "wait_start",
+	ReasonDepthWaitComplete:      "depth_wait_complete",
+	ReasonActivationWaitComplete: "activation_wait_complete",
+	ReasonQuietWaitComplete:      "quiet_wait_complete",
+	ReasonThrottleSleep:          "throttle_sleep",
+	ReasonSelfWaitDetected:       "self_wait_detected",
+}
+
+// reasonNames holds the names of all reasons, indexed by Reason; it is replaced on registration
+var reasonNames atomic.Pointer[[]string]
+
+// reasonMu serializes RegisterReason
+var reasonMu sync.Mutex
+
+func init() {
+	names := slices.Clone(builtinReasonNames)
+	reasonNames.Store(&names)
+}
+
+// String returns the name of the reason.
+func (r Reason) String() string {
+	names := *reasonNames.Load()
+	if int(r) < len(names) {
+		return names[r]
+	}
+	return "Reason(" + strconv.FormatUint(uint64(r), 10) + ")"
+}
+
+// RegisterReason returns a new Reason with the given name, for integrations that emit their own
+// events. Registering a name that is already known returns the existing Reason.
+func RegisterReason(name string) Reason {
+	reasonMu.Lock()
+	defer reasonMu.Unlock()
+
+	names := *reasonNames.Load()
+	if i := slices.Index(names, name); i >= 0 {
+		return Reason(i)
+	}
+	grown := append(slices.Clone(names), name)
+	reasonNames.Store(&grown)
+	return Reason(len(grown) - 1)
+}
+
+// YieldEvent describes a single yieldpoint event delivered to the trace func.
+// Duration is the time spent waiting or yielding, and zero for instantaneous events.
+// The Caller fields are only set when SetTraceCallers is enabled.
+type YieldEvent struct {
+	GoroutineID uint64
+	Reason      Reason
+	Duration    time.Duration
+	Timestamp   time.Time
+
+	// CallerFile and CallerLine locate the call into the package that caused the event.
+	CallerFile string
+	CallerLine int
+	// CallerFunction is the fully qualified name of the function containing that call.
+	CallerFunction string
+
+	// Stack is the formatted stack of the goroutine that produced the event, as returned by
+	// runtime.Stack. It is only set for reasons selected with SetTraceStacks.
+	Stack []byte
+
+	// Wakeups is the number of times a waiter was woken only to find a section active again.
+	// It is only set on the completion events of WaitIfActiveLimited.
+	Wakeups int
+
+	// SpinStage is the stage in which WaitIfActiveFast saw the sections clear.
+	// It is only set on ReasonWaitCompleteFast events.
+	SpinStage SpinStage
+
+	// Generation is the value of Generation when the event was emitted, which tells apart
+	// events from consecutive activations.
+	Generation uint64
+}
+
+// traceSubscriber wraps a trace func so it can be found again for removal
+type traceSubscriber struct {
+	fn func(YieldEvent)
+	// remaining counts down the events left for a SetTraceFuncN subscriber; it is nil for the others
+	remaining *atomic.Int64
+}
+
+// deliver passes e to the subscriber, counting it down and removing it
+// once it has received its last event.
+func (s *traceSubscriber) deliver(e YieldEvent) {
+	if s.remaining == nil {
+		deliverTraceEvent(s.fn, e)
+		return
+	}
+	left := s.remaining.Add(-1)
+	if left < 0 {
+		return
+	}
+	deliverTraceEvent(s.fn, e)
+	if left == 0 {
+		removeTraceSubscriber(s)
+	}
+}
+
+// traceSubscribers holds the installed trace funcs, or nil when tracing is off; it is replaced on change
+var traceSubscribers atomic.Pointer[[]*traceSubscriber]
+
+// traceMu serializes changes to traceSubscribers
+var traceMu sync.Mutex
+
+// traceCallers enables caller capture on trace events
+var traceCallers atomic.Bool
+
+// traceStacks is the set of reasons that capture a stack, or nil when none do
+var traceStacks atomic.Pointer[map[Reason]struct{}]
+
+// initialStackSize is the first buffer size tried when capturing a stack
+const initialStackSize = 4 << 10
+
+// maxCallerDepth bounds how many frames are walked looking for the caller outside the package
+const maxCallerDepth = 32
+
+// packagePrefix is the prefix shared by the qualified names of all functions in this package
+var packagePrefix = func() string {
+	pc, _, _, _ := runtime.Caller(0)
+	name := runtime.FuncForPC(pc).Name()
+	slash := strings.LastIndexByte(name, '/')
+	return name[:slash+strings.IndexByte(name[slash+1:], '.')+2]
+}()
+
+// SetTraceFunc installs fn to receive every YieldEvent, replacing all trace funcs installed
+// before, including those added with AddTraceFunc. A nil fn turns tracing off.
+// fn is called synchronously on the goroutine that caused the event and must be safe for concurrent use.
+//
+// It returns the trace func that was installed before, or nil if tracing was off, so a caller
+// can restore it later. When several subscribers were installed, the returned func delivers
+// to all of them, and restoring it turns them into a single subscriber.
+func SetTraceFunc(fn func(YieldEvent)) (prev func(YieldEvent)) {
+	traceMu.Lock()
+	defer traceMu.Unlock()
+
+	prev = currentTraceFuncLocked()
+	storeTraceFuncLocked(fn)
+	return prev
+}
+
+// SetTraceFuncN is like SetTraceFunc, but fn receives at most n events and is then removed as if
+// SetTraceFunc(nil) had been called, which suits capturing a single window during an incident.
+// Exactly n events are delivered even when they are emitted concurrently. Funcs added with
+// AddTraceFunc after the call stay installed. A nil fn or non-positive n turns tracing off.
+func SetTraceFuncN(fn func(YieldEvent), n int) (prev func(YieldEvent)) {
+	traceMu.Lock()
+	defer traceMu.Unlock()
+
+	prev = currentTraceFuncLocked()
+	if fn == nil || n <= 0 {
+		storeTraceFuncLocked(nil)
+		return prev
+	}
+	sub := &traceSubscriber{fn: fn, remaining: new(atomic.Int64)}
+	sub.remaining.Store(int64(n))
+	subs := []*traceSubscriber{sub}
+	traceSubscribers.Store(&subs)
+	return prev
+}
+
+// WrapTraceFunc replaces the installed trace funcs with mw(next), where next delivers to them.
+// next is a no-op when tracing was off, so mw can always call it. The swap is atomic with respect
+// to concurrent SetTraceFunc, AddTraceFunc and WrapTraceFunc calls.
+// Like SetTraceFunc, it returns the trace func installed before, or nil.
+func WrapTraceFunc(mw func(next func(YieldEvent)) func(YieldEvent)) (prev func(YieldEvent)) {
+	traceMu.Lock()
+	defer traceMu.Unlock()
+
+	prev = currentTraceFuncLocked()
+	next := prev
+	if next == nil {
+		next = func(YieldEvent) {}
+	}
+	storeTraceFuncLocked(mw(next))
+	return prev
+}
+
+// currentTraceFuncLocked returns a func delivering to the installed subscribers, or nil if there are none.
+// traceMu must be held.
+func currentTraceFuncLocked() func(YieldEvent) {
+	subs := traceSubscribers.Load()
+	if subs == nil {
+		return nil
+	}
+	if len(*subs) == 1 && (*subs)[0].remaining == nil {
+		return (*subs)[0].fn
+	}
+	list := *subs
+	return func(e YieldEvent) {
+		for _, sub := range list {
+			sub.deliver(e)
+		}
+	}
+}
+
+// storeTraceFuncLocked makes fn the only subscriber, or turns tracing off if fn is nil.
+// traceMu must be held.
+func storeTraceFuncLocked(fn func(YieldEvent)) {
+	if fn == nil {
+		traceSubscribers.Store(nil)
+		return
+	}
+	subs := []*traceSubscriber{{fn: fn}}
+	traceSubscribers.Store(&subs)
+}
+
+// AddTraceFunc subscribes fn to every YieldEvent alongside the trace funcs already installed,
+// and returns a func that unsubscribes it. Events are delivered to subscribers in the order
+// they were added, and a panic in one subscriber is recovered so the others still receive the event.
+// An event being emitted concurrently with remove may still reach fn once.
+func AddTraceFunc(fn func(YieldEvent)) (remove func()) {
+	if fn == nil {
+		return func() {}
+	}
+
+	sub := &traceSubscriber{fn: fn}
+	traceMu.Lock()
+	var subs []*traceSubscriber
+	if cur := traceSubscribers.Load(); cur != nil {
+		subs = slices.Clone(*cur)
+	}
+	subs = append(subs, sub)
+	traceSubscribers.Store(&subs)
+	traceMu.Unlock()
+
+	return func() { removeTraceSubscriber(sub) }
+}
+
+// removeTraceSubscriber unsubscribes sub, turning tracing off if it was the last subscriber.
+// It does nothing if sub is no longer installed.
+func removeTraceSubscriber(sub *traceSubscriber) {
+	traceMu.Lock()
+	defer traceMu.Unlock()
+
+	cur := traceSubscribers.Load()
+	if cur == nil {
+		return
+	}
+	i := slices.Index(*cur, sub)
+	if i < 0 {
+		return
+	}
+	subs := slices.Delete(slices.Clone(*cur), i, i+1)
+	if len(subs) == 0 {
+		traceSubscribers.Store(nil)
+		return
+	}
+	traceSubscribers.Store(&subs)
+}
+
+// SetTraceCallers enables or disables recording, on every trace event, the location of the call
+// into the package that caused it. It is off by default because walking the stack costs
+// around a microsecond per event.
+func SetTraceCallers(enabled bool) {
+	traceCallers.Store(enabled)
+}
+
+// SetTraceStacks selects the reasons whose trace events carry the stack of the goroutine that
+// produced them, replacing any previous selection. Calling it with no reasons disables capture.
+// Capturing a stack is expensive, so select only rare events such as
+// ReasonEnterHighPriority and ReasonExitHighPriority.
+func SetTraceStacks(reasons ...Reason) {
+	if len(reasons) == 0 {
+		traceStacks.Store(nil)
+		return
+	}
+	set := make(map[Reason]struct{}, len(reasons))
+	for _, r := range reasons {
+		set[r] = struct{}{}
+	}
+	traceStacks.Store(&set)
+}
+
+// traceYieldEvent delivers an event to every installed trace func.
+func traceYieldEvent(reason Reason, d time.Duration) {
+	traceWaitEvent(reason, d, 0)
+}
+
+// traceWaitEvent is traceYieldEvent for an event that also reports a wakeup count.
+func traceWaitEvent(reason Reason, d time.Duration, wakeups int) {
+	traceEvent(YieldEvent{Reason: reason, Duration: d, Wakeups: wakeups})
+}
+
+// traceEvent fills in the goroutine, timestamp, generation, caller and stack of e
+// and delivers it to every installed trace func.
+func traceEvent(e YieldEvent) {
+	countReason(e.Reason)
+	subs := traceSubscribers.Load()
+	if subs == nil || !sampleTraceEvent(e.Reason) {
+		return
+	}
+	e.GoroutineID = getGoroutineID()
+	e.Timestamp = time.Now()
+	e.Generation = generation.Load()
+	if traceCallers.Load() {
+		if f, ok := callerOutsidePackage(); ok {
+			e.CallerFile, e.CallerLine, e.CallerFunction = f.File, f.Line, f.Function
+		}
+	}
+	if set := traceStacks.Load(); set != nil {
+		if _, ok := (*set)[e.Reason]; ok {
+			e.Stack = captureStack()
+		}
+	}
+	if r := asyncTrace.Load(); r != nil {
+		r.push(e)
+		return
+	}
+	for _, sub := range *subs {
+		sub.deliver(e)
+	}
+}
+
+// deliverTraceEvent calls fn with e, recovering from any panic in fn.
+func deliverTraceEvent(fn func(YieldEvent), e YieldEvent) {
+	defer func() { _ = recover() }()
+	fn(e)
+}
+
+// callerOutsidePackage returns the innermost stack frame that does not belong to this package.
+// It reports false for goroutines started by the package itself.
+func callerOutsidePackage() (runtime.Frame, bool) {
+	var pcs [maxCallerDepth]uintptr
+	// Skip runtime.Callers, callerOutsidePackage and traceEvent.
+	n := runtime.Callers(3, pcs[:])
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		f, more := frames.Next()
+		if !strings.HasPrefix(f.Function, packagePrefix) {
+			return f, f.Function != "" && !strings.HasPrefix(f.Function, "runtime.")
+		}
+		if !more {
+			return runtime.Frame{}, false
+		}
+	}
+}
+
+// captureStack returns the formatted stack of the current goroutine,
+// growing the buffer until the stack fits.
+func captureStack() []byte {
+	buf := make([]byte, initialStackSize)
+	for {
+		n := runtime.Stack(buf, false)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// fallbackGoroutineID hands out IDs when a stack header cannot be parsed. It starts in the top
+// half of the range, far above the IDs the runtime assigns, so the two never collide.
+var fallbackGoroutineID atomic.Uint64
+
+func init() {
+	fallbackGoroutineID.Store(1 << 63)
+}
+
+// getGoroutineID returns the ID of the calling goroutine, parsed from the
+// "goroutine N [...]" header of its stack trace. It never returns 0: if the header cannot
+// be parsed, it returns a fresh ID from a separate range, which is unique but, unlike the
+// runtime's, differs between calls on the same goroutine.
+func getGoroutineID() uint64 {
+	var buf [64]byte
+	if id, ok := parseGoroutineID(buf[:runtime.Stack(buf[:], false)]); ok {
+		return id
+	}
+	return fallbackGoroutineID.Add(1)
+}
+
+// parseGoroutineID parses the leading "goroutine N " of a stack trace, and reports false
+// unless N is a non-zero decimal integer that fits in a uint64.
+func parseGoroutineID(stack []byte) (uint64, bool) {
+	b, ok := bytes.CutPrefix(stack, []byte("goroutine "))
+	if !ok {
+		return 0, false
+	}
+	var id uint64
+	i := 0
+	for ; i < len(b) && '0' <= b[i] && b[i] <= '9'; i++ {
+		d := uint64(b[i] - '0')
+		if id > (math.MaxUint64-d)/10 {
+			return 0, false
+		}
+		id = id*10 + d
+	}
+	if i == 0 || i == len(b) || b[i] != ' ' || id == 0 {
+		return 0, false
+	}
+	return id, true
+}
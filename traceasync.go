@@ -0,0 +1,177 @@
+package yieldpoint
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DropPolicy decides which event is lost when the asynchronous trace buffer is full.
+type DropPolicy int
+
+const (
+	// DropNewest discards the event being emitted and keeps the buffered ones.
+	DropNewest DropPolicy = iota
+	// DropOldest discards the oldest buffered event to make room for the new one.
+	DropOldest
+)
+
+// traceRing is a bounded buffer of events drained by a dispatcher goroutine
+type traceRing struct {
+	mu     sync.Mutex
+	buf    []YieldEvent
+	head   int
+	n      int
+	policy DropPolicy
+
+	notify chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+
+	// enqueued counts events accepted into buf; completed counts those delivered or dropped since
+	enqueued  atomic.Uint64
+	completed atomic.Uint64
+}
+
+var (
+	// asyncMu serializes SetTraceAsync
+	asyncMu sync.Mutex
+	// asyncTrace is the active buffer, or nil when events are delivered synchronously
+	asyncTrace atomic.Pointer[traceRing]
+	// traceDropped counts events lost because the asynchronous buffer was full
+	traceDropped atomic.Uint64
+)
+
+// SetTraceAsync switches trace delivery to a dispatcher goroutine fed by a buffer of capacity events,
+// so a slow trace func no longer stalls the goroutine that emitted the event. When the buffer is full,
+// policy decides which event is dropped, and TraceDropped counts the loss.
+// A non-positive capacity restores synchronous delivery after the buffered events are delivered.
+// Events emitted while the mode is being changed may be lost.
+func SetTraceAsync(capacity int, policy DropPolicy) {
+	asyncMu.Lock()
+	defer asyncMu.Unlock()
+
+	var r *traceRing
+	if capacity > 0 {
+		r = &traceRing{
+			buf:    make([]YieldEvent, capacity),
+			policy: policy,
+			notify: make(chan struct{}, 1),
+			stop:   make(chan struct{}),
+			done:   make(chan struct{}),
+		}
+		go r.run()
+	}
+
+	if old := asyncTrace.Swap(r); old != nil {
+		close(old.stop)
+		<-old.done
+	}
+}
+
+// TraceDropped returns the number of trace events dropped because the asynchronous buffer was full.
+func TraceDropped() uint64 {
+	return traceDropped.Load()
+}
+
+// FlushTraces blocks until every event buffered before the call has been delivered or dropped,
+// or ctx is done. It returns immediately when delivery is synchronous.
+func FlushTraces(ctx context.Context) error {
+	r := asyncTrace.Load()
+	if r == nil {
+		return nil
+	}
+	target := r.enqueued.Load()
+	if r.completed.Load() >= target {
+		return nil
+	}
+
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return contextError(ctx)
+		case <-r.done:
+			return nil
+		case <-ticker.C:
+			if r.completed.Load() >= target {
+				return nil
+			}
+		}
+	}
+}
+
+// push adds e to the buffer, applying the drop policy if it is full.
+func (r *traceRing) push(e YieldEvent) {
+	r.mu.Lock()
+	if r.n == len(r.buf) {
+		traceDropped.Add(1)
+		if r.policy == DropNewest {
+			r.mu.Unlock()
+			return
+		}
+		r.buf[r.head] = YieldEvent{}
+		r.head = (r.head + 1) % len(r.buf)
+		r.n--
+		r.completed.Add(1)
+	}
+	r.buf[(r.head+r.n)%len(r.buf)] = e
+	r.n++
+	r.enqueued.Add(1)
+	r.mu.Unlock()
+
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+}
+
+// take moves every buffered event into batch and returns it.
+func (r *traceRing) take(batch []YieldEvent) []YieldEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for ; r.n > 0; r.n-- {
+		batch = append(batch, r.buf[r.head])
+		r.buf[r.head] = YieldEvent{}
+		r.head = (r.head + 1) % len(r.buf)
+	}
+	return batch
+}
+
+// run delivers buffered events until stop is closed, then delivers what is left and closes done.
+func (r *traceRing) run() {
+	defer close(r.done)
+
+	batch := make([]YieldEvent, 0, len(r.buf))
+	for {
+		stopping := false
+		select {
+		case <-r.notify:
+		case <-r.stop:
+			stopping = true
+		}
+
+		for {
+			batch = r.take(batch[:0])
+			if len(batch) == 0 {
+				break
+			}
+			for i := range batch {
+				if subs := traceSubscribers.Load(); subs != nil {
+					for _, sub := range *subs {
+						sub.deliver(batch[i])
+					}
+				}
+				r.completed.Add(1)
+			}
+			clear(batch)
+		}
+
+		if stopping {
+			return
+		}
+	}
+}
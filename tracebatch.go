@@ -0,0 +1,148 @@
+package yieldpoint
+
+import (
+	"sync"
+	"time"
+)
+
+// traceBatcher collects events for a SetTraceBatch func and hands them over from a flusher goroutine
+type traceBatcher struct {
+	mu   sync.Mutex
+	buf  []YieldEvent
+	size int
+	fn   func([]YieldEvent)
+
+	remove func()
+	notify chan struct{}
+	ticker *time.Ticker
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+var (
+	// batchMu serializes SetTraceBatch and StopTraceBatch
+	batchMu sync.Mutex
+	// traceBatch is the installed batcher, or nil
+	traceBatch *traceBatcher
+)
+
+// SetTraceBatch subscribes fn to receive trace events in slices instead of one call per event,
+// trading delivery latency for lower per-event overhead. A slice is delivered as soon as size
+// events have accumulated, and whatever has accumulated is delivered every flush. fn is called
+// from a single background goroutine, never concurrently, and owns the slices it receives.
+// A non-positive flush only delivers full slices until StopTraceBatch.
+//
+// fn is subscribed alongside other trace funcs like AddTraceFunc, so SetTraceFunc removes it.
+// A previous batch func is stopped and drained first. A nil fn or non-positive size only stops it.
+func SetTraceBatch(size int, flush time.Duration, fn func([]YieldEvent)) {
+	batchMu.Lock()
+	defer batchMu.Unlock()
+
+	stopTraceBatchLocked()
+	if fn == nil || size <= 0 {
+		return
+	}
+	b := &traceBatcher{
+		buf:    make([]YieldEvent, 0, size),
+		size:   size,
+		fn:     fn,
+		notify: make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if flush > 0 {
+		b.ticker = time.NewTicker(flush)
+	}
+	b.remove = AddTraceFunc(b.add)
+	traceBatch = b
+	go b.run()
+}
+
+// StopTraceBatch unsubscribes the func installed with SetTraceBatch, delivers the events it
+// has accumulated and returns once that delivery is done. It does nothing if none is installed.
+func StopTraceBatch() {
+	batchMu.Lock()
+	defer batchMu.Unlock()
+	stopTraceBatchLocked()
+}
+
+// stopTraceBatchLocked stops and drains the installed batcher. batchMu must be held.
+func stopTraceBatchLocked() {
+	b := traceBatch
+	if b == nil {
+		return
+	}
+	traceBatch = nil
+	b.remove()
+	close(b.stop)
+	<-b.done
+}
+
+// add buffers e, waking the flusher once a full slice is ready.
+func (b *traceBatcher) add(e YieldEvent) {
+	b.mu.Lock()
+	b.buf = append(b.buf, e)
+	full := len(b.buf) >= b.size
+	b.mu.Unlock()
+
+	if full {
+		select {
+		case b.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// take removes and returns the buffered events, or only whole slices of size events unless all is set.
+func (b *traceBatcher) take(all bool) []YieldEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := len(b.buf)
+	if !all {
+		n -= n % b.size
+	}
+	if n == 0 {
+		return nil
+	}
+	out := b.buf[:n:n]
+	b.buf = append(make([]YieldEvent, 0, b.size), b.buf[n:]...)
+	return out
+}
+
+// run delivers slices until stop is closed, then delivers what is left and closes done.
+func (b *traceBatcher) run() {
+	defer close(b.done)
+
+	var tick <-chan time.Time
+	if b.ticker != nil {
+		defer b.ticker.Stop()
+		tick = b.ticker.C
+	}
+	for {
+		all, stopping := false, false
+		select {
+		case <-b.notify:
+		case <-tick:
+			all = true
+		case <-b.stop:
+			all, stopping = true, true
+		}
+
+		events := b.take(all)
+		for len(events) > 0 {
+			n := min(len(events), b.size)
+			b.deliver(events[:n:n])
+			events = events[n:]
+		}
+		if stopping {
+			return
+		}
+	}
+}
+
+// deliver calls fn with batch, recovering from any panic in fn.
+func (b *traceBatcher) deliver(batch []YieldEvent) {
+	defer func() { _ = recover() }()
+	b.fn(batch)
+}
@@ -0,0 +1,241 @@
+package yieldpoint
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// fairWakeups enables FIFO release of blocked waiters
+var fairWakeups atomic.Bool
+
+// wakePolicyConfig is the staggered release configured with SetWakePolicy
+type wakePolicyConfig struct {
+	batch int
+	gap   time.Duration
+}
+
+// wakePolicy holds the staggered release policy, or nil to release all waiters at once
+var wakePolicy atomic.Pointer[wakePolicyConfig]
+
+// wakeOneTimeout is the safety timeout of the wake-one chain in nanoseconds, or zero when the chain is off
+var wakeOneTimeout atomic.Int64
+
+// chainNext is closed by ReleaseNext to let the wake-one chain continue; it is guarded by Mu
+var chainNext chan struct{}
+
+// States of a queuedWaiter
+const (
+	waiterQueued int32 = iota
+	waiterReleased
+	waiterCancelled
+)
+
+// queuedWaiter is a goroutine blocked in the wait queue
+type queuedWaiter struct {
+	state   atomic.Int32
+	ready   chan struct{}
+	resumed chan struct{}
+}
+
+// waitQueue holds the queued waiters in arrival order; it is guarded by Mu
+var waitQueue []*queuedWaiter
+
+// SetFairWakeups enables or disables FIFO wakeups. When enabled, goroutines blocked in
+// WaitIfActive and in the blocking phase of WaitIfActiveFast are released one at a time
+// in the order they started waiting, instead of all at once in arbitrary order. Each one
+// is woken only once the previous one has emitted its completion event and returned.
+func SetFairWakeups(enabled bool) {
+	fairWakeups.Store(enabled)
+}
+
+// SetWakePolicy makes the last ExitHighPriority release blocked waiters in arrival order,
+// batch at a time with gap between batches, instead of waking all of them at once.
+// Waiters whose context is cancelled while queued are skipped and do not count toward a batch.
+// A non-positive batch restores waking everyone at once.
+func SetWakePolicy(batch int, gap time.Duration) {
+	if batch <= 0 {
+		wakePolicy.Store(nil)
+		return
+	}
+	wakePolicy.Store(&wakePolicyConfig{batch: batch, gap: gap})
+}
+
+// SetWakeOne enables or disables the wake-one chain. When enabled, the last ExitHighPriority
+// releases a single queued waiter, and each released waiter must call ReleaseNext once the
+// resources it depends on have absorbed it, which releases the following waiter. If a released
+// waiter does not call ReleaseNext within timeout, the next one is released anyway.
+//
+// The chain only covers goroutines that were already blocked when the section ended: callers
+// arriving at WaitIfActive while the chain is still running see no active section and proceed
+// immediately, just as they do without the chain. The chain takes precedence over SetWakePolicy
+// and SetFairWakeups. A non-positive timeout disables the chain.
+func SetWakeOne(timeout time.Duration) {
+	wakeOneTimeout.Store(int64(max(timeout, 0)))
+}
+
+// ReleaseNext lets the wake-one chain release the next waiter.
+// It has no effect when no chain is waiting on it.
+func ReleaseNext() {
+	Mu.Lock()
+	if chainNext != nil {
+		close(chainNext)
+		chainNext = nil
+	}
+	Mu.Unlock()
+}
+
+// queuedWakeups reports whether waiters should block in the wait queue.
+func queuedWakeups() bool {
+	return fairWakeups.Load() || wakePolicy.Load() != nil || wakeOneTimeout.Load() > 0
+}
+
+// enqueueWaiter adds a waiter to the queue, or returns nil if no sections are active.
+func enqueueWaiter() *queuedWaiter {
+	Mu.Lock()
+	defer Mu.Unlock()
+	if HighPriorityCount.Load() == 0 {
+		return nil
+	}
+	w := &queuedWaiter{ready: make(chan struct{}), resumed: make(chan struct{})}
+	waitQueue = append(waitQueue, w)
+	return w
+}
+
+// waitQueued blocks in the wait queue until no high-priority sections are active. It returns
+// the waiter it was released as, whose handoff the caller finishes once its wait has returned,
+// or nil if it never had to queue.
+func waitQueued() *queuedWaiter {
+	for {
+		w := enqueueWaiter()
+		if w == nil {
+			return nil
+		}
+		<-w.ready
+		if HighPriorityCount.Load() == 0 {
+			return w
+		}
+		finishHandoff(w)
+	}
+}
+
+// waitQueuedContext blocks in the wait queue until no high-priority sections are active or ctx is done.
+// Like waitQueued, it returns the waiter whose handoff the caller finishes.
+func waitQueuedContext(ctx context.Context) (*queuedWaiter, error) {
+	for {
+		w := enqueueWaiter()
+		if w == nil {
+			return nil, nil
+		}
+		select {
+		case <-w.ready:
+		case <-ctx.Done():
+			if w.state.CompareAndSwap(waiterQueued, waiterCancelled) {
+				return nil, contextError(ctx)
+			}
+			// Released concurrently; the caller finishes the handoff before reporting the cancellation.
+			<-w.ready
+			return w, contextError(ctx)
+		}
+		if HighPriorityCount.Load() == 0 {
+			return w, nil
+		}
+		finishHandoff(w)
+	}
+}
+
+// finishHandoff tells a fair release that w's wait has returned, so it can wake the next waiter.
+// It has no effect on a nil w.
+func finishHandoff(w *queuedWaiter) {
+	if w != nil {
+		close(w.resumed)
+	}
+}
+
+// releaseQueue wakes the queued waiters in order. In fair mode it lets each one resume
+// before waking the next, and with a wake policy it pauses between batches.
+// After Shutdown it wakes all remaining waiters at once.
+func releaseQueue(q []*queuedWaiter) {
+	if timeout := time.Duration(wakeOneTimeout.Load()); timeout > 0 {
+		releaseChain(q, timeout)
+		return
+	}
+
+	fair := fairWakeups.Load()
+	policy := wakePolicy.Load()
+
+	done := shutdownChan()
+	inBatch := 0
+	for i, w := range q {
+		if policy != nil && inBatch == policy.batch {
+			timer := time.NewTimer(policy.gap)
+			select {
+			case <-timer.C:
+			case <-done:
+				timer.Stop()
+			}
+			inBatch = 0
+		}
+		if shutdown.Load() {
+			releaseAll(q[i:])
+			return
+		}
+		if !w.state.CompareAndSwap(waiterQueued, waiterReleased) {
+			continue
+		}
+		close(w.ready)
+		if fair {
+			select {
+			case <-w.resumed:
+			case <-done:
+			}
+		}
+		inBatch++
+	}
+}
+
+// releaseAll wakes all the queued waiters in q at once.
+func releaseAll(q []*queuedWaiter) {
+	for _, w := range q {
+		if w.state.CompareAndSwap(waiterQueued, waiterReleased) {
+			close(w.ready)
+		}
+	}
+}
+
+// releaseChain wakes the queued waiters one at a time, moving on when ReleaseNext is called
+// or the timeout elapses. After Shutdown it wakes all remaining waiters at once.
+func releaseChain(q []*queuedWaiter, timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	done := shutdownChan()
+	for i, w := range q {
+		if shutdown.Load() {
+			releaseAll(q[i:])
+			return
+		}
+		if !w.state.CompareAndSwap(waiterQueued, waiterReleased) {
+			continue
+		}
+
+		next := make(chan struct{})
+		Mu.Lock()
+		chainNext = next
+		Mu.Unlock()
+
+		close(w.ready)
+
+		timer.Reset(timeout)
+		select {
+		case <-next:
+		case <-done:
+		case <-timer.C:
+			Mu.Lock()
+			if chainNext == next {
+				chainNext = nil
+			}
+			Mu.Unlock()
+		}
+	}
+}
@@ -3,7 +3,9 @@ package yieldpoint
 
 import (
 	"context"
+	"math"
 	"runtime"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -12,111 +14,1203 @@ import (
 // HighPriorityCount tracks the number of active high-priority sections
 var HighPriorityCount atomic.Int32
 
-// Mu is the mutex used for efficient blocking in WaitIfActive
+// generation is incremented every time the high-priority count rises from zero
+var generation atomic.Uint64
+
+// activeWeight is the total weight of the active high-priority sections
+var activeWeight atomic.Int64
+
+// Mu is the mutex guarding Cond and the package's waiter bookkeeping
 var Mu sync.Mutex
 
-// Cond is the condition variable used for efficient blocking
+// Cond is the condition variable broadcast whenever the high-priority count drops to zero.
+// WaitIfActive no longer waits on it, but it is still signalled for code that does.
 var Cond = sync.NewCond(&Mu)
 
-// DefaultYieldDuration is the default duration to sleep when yielding
+// clearCh is closed and cleared when the high-priority count drops to zero.
+// Waiters install it lazily, so no channel is allocated while nobody waits.
+var clearCh atomic.Pointer[chan struct{}]
+
+// depthWaiters counts goroutines blocked in WaitForDepthBelow, which need a broadcast on every exit
+var depthWaiters atomic.Int32
+
+// prioritySleepSlice is how often PrioritySleep checks for active high-priority sections
+const prioritySleepSlice = time.Millisecond
+
+// waiters counts goroutines currently blocked waiting for high-priority sections to end
+var waiters atomic.Int32
+
+// activationWaiters counts goroutines blocked in WaitForHighPriority, which need a broadcast on the 0→1 transition
+var activationWaiters atomic.Int32
+
+// closedCh is an always-closed channel handed out when nothing is active
+var closedCh = make(chan struct{})
+
+// DefaultYieldDuration is the yield duration used until SetDefaultYieldDuration is called.
+//
+// Deprecated: it is only read when the package is initialized, so assigning to it has no effect;
+// use SetDefaultYieldDuration and GetDefaultYieldDuration.
 var DefaultYieldDuration = 1 * time.Millisecond
 
-// SpinWaitIterations is the number of iterations to spin-wait before falling back to mutex-based waiting
-var SpinWaitIterations = 1000
+// yieldDuration is the yield duration set by SetDefaultYieldDuration, in nanoseconds
+var yieldDuration atomic.Int64
+
+// DefaultSpinWaitIterations is the number of spin-wait iterations used until SetSpinWaitIterations is called
+const DefaultSpinWaitIterations = 1000
+
+// SpinWaitIterations was the number of iterations to spin-wait before falling back to mutex-based waiting.
+//
+// Deprecated: it is no longer read, so assigning to it has no effect; use SetSpinWaitIterations,
+// GetSpinWaitIterations or SetSpinBudget.
+var SpinWaitIterations = DefaultSpinWaitIterations
+
+// spinWaitIterations is the number of iterations to spin-wait before falling back to mutex-based waiting
+var spinWaitIterations atomic.Int32
+
+// spinBudget is how long WaitIfActiveFast spins, in nanoseconds; zero means spinWaitIterations is used
+var spinBudget atomic.Int64
 
+// spinBackoff holds the staged spin configuration of WaitIfActiveFast, or nil if unset
+var spinBackoff atomic.Pointer[SpinBackoff]
 
-// SetSpinWaitIterations sets the number of iterations to spin-wait before falling back to mutex-based waiting
+// broadcastDebounce is how long the zero-count wakeup is delayed, in nanoseconds
+var broadcastDebounce atomic.Int64
+
+// debouncePending is set while a debounced zero-count wakeup is scheduled
+var debouncePending atomic.Bool
+
+// imbalanceHandler is called when ExitHighPriority is called more often than EnterHighPriority
+var imbalanceHandler atomic.Pointer[func(delta int)]
+
+// yieldAction is the function the MaybeYield family calls to yield, or nil for runtime.Gosched
+var yieldAction atomic.Pointer[func()]
+
+// yieldDecider is consulted before MaybeYield and MaybeYieldNonBlocking yield, or nil to always yield
+var yieldDecider atomic.Pointer[func(depth int) bool]
+
+// spinMode is the SpinMode used by the spin phase of WaitIfActiveFast
+var spinMode atomic.Int32
+
+// busySpinGoschedInterval is how many busy spin iterations pass between runtime.Gosched calls in SpinBusy mode
+const busySpinGoschedInterval = 64
+
+// spinClockCheckInterval is how many spin iterations pass between clock reads when spinning on a budget
+const spinClockCheckInterval = 16
+
+func init() {
+	close(closedCh)
+	yieldDuration.Store(int64(DefaultYieldDuration))
+	spinWaitIterations.Store(DefaultSpinWaitIterations)
+}
+
+// SetSpinWaitIterations sets the number of iterations to spin-wait before falling back to mutex-based waiting.
+// Negative values are clamped to zero, and zero makes WaitIfActiveFast block immediately without spinning.
+// It is safe to call concurrently with WaitIfActiveFast.
+//
+// The iteration count is only used while no spin budget is set.
+//
+// Deprecated: iteration counts take very different amounts of time on different machines; use SetSpinBudget.
 func SetSpinWaitIterations(n int) {
-	SpinWaitIterations = n
+	if n < 0 {
+		n = 0
+	}
+	if n > math.MaxInt32 {
+		n = math.MaxInt32
+	}
+	spinWaitIterations.Store(int32(n))
+}
+
+// GetSpinWaitIterations returns the number of iterations WaitIfActiveFast spins before blocking.
+func GetSpinWaitIterations() int {
+	return int(spinWaitIterations.Load())
+}
+
+// SetSpinBudget sets how long WaitIfActiveFast spins before falling back to mutex-based waiting.
+// A non-positive budget restores the iteration-based spin configured with SetSpinWaitIterations.
+func SetSpinBudget(d time.Duration) {
+	spinBudget.Store(int64(max(d, 0)))
+}
+
+// GetSpinBudget returns the spin budget of WaitIfActiveFast, or zero if spinning is iteration-based.
+func GetSpinBudget() time.Duration {
+	return time.Duration(spinBudget.Load())
+}
+
+// SpinMode selects how WaitIfActiveFast spends each spin iteration.
+type SpinMode int32
+
+const (
+	// SpinGosched calls runtime.Gosched on every spin iteration. It lets other goroutines run
+	// on the same processor while spinning, at the cost of a scheduler round trip per check.
+	SpinGosched SpinMode = iota
+	// SpinBusy re-checks the count in a tight loop and only calls runtime.Gosched every few
+	// iterations. It reacts fastest to very short sections but burns a whole CPU while spinning,
+	// so it suits dedicated cores. Iteration-based spins also end much sooner in this mode.
+	SpinBusy
+)
+
+// SetSpinMode sets how WaitIfActiveFast spins before blocking. It applies to the iteration-
+// and budget-based spin, not to the stages configured with SetSpinBackoff.
+func SetSpinMode(mode SpinMode) {
+	spinMode.Store(int32(mode))
+}
+
+// SpinBackoff describes the stages WaitIfActiveFast goes through before blocking on Cond.
+// Each stage re-checks the high-priority count before escalating to the next one.
+type SpinBackoff struct {
+	// Spins is the number of tight checks of the count, without yielding the processor.
+	Spins int
+	// Yields is the number of checks separated by runtime.Gosched.
+	Yields int
+	// Sleeps are escalating sleeps taken after the yield stage, one check after each.
+	Sleeps []time.Duration
+}
+
+// SpinStage is the stage of WaitIfActiveFast in which the sections were seen to clear.
+// It is reported in the SpinStage field of ReasonWaitCompleteFast events.
+type SpinStage uint8
+
+const (
+	// SpinStageNone is the zero value, carried by every other event.
+	SpinStageNone SpinStage = iota
+	// SpinStageSpin is the tight checks of SpinBackoff.Spins, or the iteration- or
+	// budget-based spin when no SpinBackoff is configured.
+	SpinStageSpin
+	// SpinStageYield is the checks separated by runtime.Gosched of SpinBackoff.Yields.
+	SpinStageYield
+	// SpinStageSleep is the escalating sleeps of SpinBackoff.Sleeps.
+	SpinStageSleep
+	// SpinStageBlock means the waiter gave up spinning and blocked, or used a wait strategy.
+	SpinStageBlock
+)
+
+// spinStageNames holds the String form of each SpinStage
+var spinStageNames = [...]string{
+	SpinStageNone:  "",
+	SpinStageSpin:  "spin",
+	SpinStageYield: "yield",
+	SpinStageSleep: "sleep",
+	SpinStageBlock: "block",
+}
+
+// String returns the stage's name, such as "yield", or "" for SpinStageNone.
+func (s SpinStage) String() string {
+	if int(s) < len(spinStageNames) {
+		return spinStageNames[s]
+	}
+	return "SpinStage(" + strconv.FormatUint(uint64(s), 10) + ")"
+}
+
+// SetSpinBackoff makes WaitIfActiveFast spin in the stages described by b before blocking,
+// taking precedence over the spin budget and iteration count. A nil b removes the staged configuration.
+func SetSpinBackoff(b *SpinBackoff) {
+	if b == nil {
+		spinBackoff.Store(nil)
+		return
+	}
+	c := *b
+	c.Sleeps = append([]time.Duration(nil), b.Sleeps...)
+	spinBackoff.Store(&c)
+}
+
+// SetDefaultYieldDuration sets the yield duration: how long YieldBudget.MaybeYield sleeps when its
+// budget allows, and how close a context deadline must be for MaybeYieldWithContext to skip its yield.
+// MaybeYield and the other package-level yields call runtime.Gosched or the yield action and never sleep.
+// Negative values are clamped to zero; a zero duration makes YieldBudget.MaybeYield never sleep.
+// It is safe to call concurrently with yielding goroutines.
+func SetDefaultYieldDuration(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	yieldDuration.Store(int64(d))
+}
+
+// GetDefaultYieldDuration returns the yield duration set by SetDefaultYieldDuration.
+func GetDefaultYieldDuration() time.Duration {
+	return time.Duration(yieldDuration.Load())
+}
+
+// SetYieldAction makes the MaybeYield family call fn instead of runtime.Gosched when they yield.
+// A nil fn restores the default.
+func SetYieldAction(fn func()) {
+	if fn == nil {
+		yieldAction.Store(nil)
+		return
+	}
+	yieldAction.Store(&fn)
+}
+
+// SetYieldDecider installs fn to be consulted by MaybeYield and MaybeYieldNonBlocking whenever
+// high priority is active, with depth set to the number of active sections. Returning false
+// suppresses the yield and emits a ReasonYieldSuppressed trace event. A nil fn restores the default
+// of always yielding. fn must be safe for concurrent use.
+func SetYieldDecider(fn func(depth int) bool) {
+	if fn == nil {
+		yieldDecider.Store(nil)
+		return
+	}
+	yieldDecider.Store(&fn)
+}
+
+// yieldAllowed reports whether the yield decider, if any, lets a yield at depth happen.
+func yieldAllowed(depth int32) bool {
+	fn := yieldDecider.Load()
+	if fn == nil || (*fn)(int(depth)) {
+		return true
+	}
+	traceYieldEvent(ReasonYieldSuppressed, 0)
+	return false
+}
+
+// yieldNow performs a single yield using the configured yield action, unless the goroutine
+// has used its SetYieldBudget.
+func yieldNow() {
+	if yieldWithinBudget() {
+		yieldFor(0)
+	}
+}
+
+// yieldWithinBudget reports whether the current goroutine may yield under SetYieldBudget,
+// emitting a ReasonYieldSuppressed event if not.
+func yieldWithinBudget() bool {
+	if yieldBudgetAllows() {
+		return true
+	}
+	traceYieldEvent(ReasonYieldSuppressed, 0)
+	return false
+}
+
+// yieldFor performs a single yield that sleeps for sleep, or uses the configured yield action if
+// sleep is not positive. The yield is counted, timed and traced like every yield of the MaybeYield family.
+func yieldFor(sleep time.Duration) {
+	if testMode.Load() {
+		yieldIntents.Add(1)
+		return
+	}
+	region := startRuntimeRegion("yieldpoint.MaybeYield")
+	start := time.Now()
+	if sleep > 0 {
+		time.Sleep(sleep)
+	} else if fn := yieldAction.Load(); fn != nil {
+		(*fn)()
+	} else {
+		runtime.Gosched()
+	}
+	endRuntimeRegion(region)
+	d := time.Since(start)
+	yieldCount.Add(1)
+	observeDuration(d)
+	if goroutineAccounting.Load() {
+		accountGoroutine(false, d)
+	}
+	traceYieldEvent(ReasonHighPriorityActive, d)
 }
 
 // MaybeYield voluntarily yields the current goroutine if any high-priority sections are active.
+// With SetThrottle configured, it applies the duty cycle instead of yielding on every call.
+// While the package is paused, it blocks at the yield point until Resume is called.
 func MaybeYield() {
-	if HighPriorityCount.Load() > 0 {
-		runtime.Gosched()
+	if depth := HighPriorityCount.Load(); depth > 0 && !holdsCeiling() && yieldAllowed(depth) && !throttled() {
+		yieldNow()
+	}
+	if paused.Load() {
+		waitWhilePaused()
+	}
+}
+
+// MaybeYieldNonBlocking is like MaybeYield but never blocks while the package is paused.
+// It is meant for workers that must never stall.
+func MaybeYieldNonBlocking() {
+	if depth := HighPriorityCount.Load(); depth > 0 && !holdsCeiling() && yieldAllowed(depth) {
+		yieldNow()
+	}
+}
+
+// MaybeYieldAbove yields the current goroutine only if more than threshold
+// high-priority sections are active.
+func MaybeYieldAbove(threshold int32) {
+	if HighPriorityCount.Load() > threshold && !holdsCeiling() {
+		yieldNow()
+	}
+}
+
+// MaybeYieldWeighted yields the current goroutine only if the total weight of the
+// active high-priority sections exceeds threshold.
+func MaybeYieldWeighted(threshold int) {
+	if activeWeight.Load() > int64(threshold) && !holdsCeiling() {
+		yieldNow()
+	}
+}
+
+// MaybeYieldIf yields like MaybeYield, but only if pred also returns true.
+// pred is only called while a high-priority section is active, so it never runs on the idle fast path.
+func MaybeYieldIf(pred func() bool) {
+	if HighPriorityCount.Load() == 0 || holdsCeiling() {
+		return
+	}
+	if pred() {
+		yieldNow()
+	} else {
+		traceYieldEvent(ReasonYieldSuppressed, 0)
 	}
 }
 
 // EnterHighPriority begins a high-priority section.
 // Multiple calls are supported through reference counting.
+// If this is the first active section, it will signal goroutines blocked in WaitForHighPriority.
+// The section carries a weight of 1.
 func EnterHighPriority() {
-	HighPriorityCount.Add(1)
+	EnterHighPriorityWeighted(1)
+}
+
+// EnterHighPriorityWeighted begins a high-priority section that contributes w to the total active weight.
+// It must be paired with ExitHighPriorityWeighted using the same weight.
+// After Shutdown it has no effect.
+func EnterHighPriorityWeighted(w int) {
+	if shutdown.Load() {
+		return
+	}
+	if trackGoroutineDepth.Load() {
+		noteGoroutineEnter()
+	}
+	activeWeight.Add(int64(w))
+	if HighPriorityCount.Add(1) == 1 {
+		markActive()
+		generation.Add(1)
+		if activationWaiters.Load() > 0 {
+			Mu.Lock()
+			Cond.Broadcast()
+			Mu.Unlock()
+		}
+	}
+	// Traced after the increment so the event carries the generation it started or joined.
+	traceYieldEvent(ReasonEnterHighPriority, 0)
+	runtimeTraceLog("enter_high_priority")
+	// Checked after the increment so an enter racing with Shutdown is always undone.
+	if shutdown.Load() {
+		ExitHighPriorityWeighted(w)
+	}
+}
+
+// EnterHighPriorityFor begins a high-priority section that exits on its own after d,
+// as a guard against sections that are never exited. The returned cancel exits it early
+// and stops the timer. The section is exited exactly once, whichever comes first.
+// With SetGoroutineDepthTracking enabled, the exit is attributed to the goroutine that
+// entered the section, whichever goroutine cancel or the timer runs on.
+func EnterHighPriorityFor(d time.Duration) (cancel func()) {
+	var owner uint64
+	if trackGoroutineDepth.Load() {
+		owner = getGoroutineID()
+	}
+	EnterHighPriority()
+
+	var exited atomic.Bool
+	exit := func() {
+		if exited.CompareAndSwap(false, true) {
+			exitSectionOf(owner, 1)
+		}
+	}
+	t := time.AfterFunc(d, exit)
+	return func() {
+		t.Stop()
+		exit()
+	}
 }
 
 // ExitHighPriority ends a high-priority section.
 // If this is the last high-priority section, it will signal any waiting goroutines.
 func ExitHighPriority() {
+	ExitHighPriorityWeighted(1)
+}
+
+// ExitHighPriorityWeighted ends a high-priority section begun with EnterHighPriorityWeighted(w).
+func ExitHighPriorityWeighted(w int) {
+	var id uint64
+	if trackGoroutineDepth.Load() {
+		id = getGoroutineID()
+	}
+	exitSectionOf(id, w)
+}
+
+// exitSectionOf ends a section of weight w entered by goroutine id. With depth tracking on,
+// the exit is attributed to id rather than to the current goroutine.
+func exitSectionOf(id uint64, w int) {
+	if trackGoroutineDepth.Load() && !noteGoroutineExit(id) {
+		if fn := imbalanceHandler.Load(); fn != nil && !shutdown.Load() {
+			(*fn)(1)
+		}
+		return
+	}
+	traceYieldEvent(ReasonExitHighPriority, 0)
+	runtimeTraceLog("exit_high_priority")
+	activeWeight.Add(-int64(w))
 	count := HighPriorityCount.Add(-1)
 	if count == 0 {
+		markInactive()
+		signalClear()
+	} else if count < 0 {
+		HighPriorityCount.Store(0)
+		activeWeight.Store(0)
+		if fn := imbalanceHandler.Load(); fn != nil && !shutdown.Load() {
+			(*fn)(int(-count))
+		}
+	} else if depthWaiters.Load() > 0 {
 		Mu.Lock()
 		Cond.Broadcast()
 		Mu.Unlock()
-	} else if count < 0 {
-		HighPriorityCount.Store(0)
 	}
 }
 
+// SetImbalanceHandler installs fn to be called whenever an exit would drive the high-priority
+// count below zero, with delta set to how far below zero it went. The count is still clamped to
+// zero. A nil fn restores the default of clamping silently. Exits that follow Shutdown are not reported.
+// With SetGoroutineDepthTracking enabled, fn is also called with delta 1 for each ignored exit.
+func SetImbalanceHandler(fn func(delta int)) {
+	if fn == nil {
+		imbalanceHandler.Store(nil)
+		return
+	}
+	imbalanceHandler.Store(&fn)
+}
+
+// SetBroadcastDebounce delays the wakeup sent when the last section exits by d. If a new
+// section starts within that window, the wakeup is skipped, so waiters are not woken only to
+// block again. Waiters still wake at most d after the count settles at zero. A non-positive d
+// turns debouncing off, which is the default.
+func SetBroadcastDebounce(d time.Duration) {
+	broadcastDebounce.Store(int64(max(d, 0)))
+}
+
+// signalClear wakes zero-count waiters, either now or after the broadcast debounce.
+func signalClear() {
+	d := time.Duration(broadcastDebounce.Load())
+	if d <= 0 {
+		Mu.Lock()
+		signalClearLocked()
+		Mu.Unlock()
+		return
+	}
+	if debouncePending.CompareAndSwap(false, true) {
+		time.AfterFunc(d, debouncedClear)
+	}
+}
+
+// debouncedClear sends a debounced wakeup if the count is still zero.
+func debouncedClear() {
+	Mu.Lock()
+	defer Mu.Unlock()
+	debouncePending.Store(false)
+	if HighPriorityCount.Load() == 0 {
+		signalClearLocked()
+	}
+}
+
+// signalClearLocked wakes everything waiting for the high-priority count to reach zero.
+// Mu must be held.
+func signalClearLocked() {
+	Cond.Broadcast()
+	if ch := clearCh.Swap(nil); ch != nil {
+		close(*ch)
+	}
+	if len(waitQueue) > 0 {
+		go releaseQueue(waitQueue)
+		waitQueue = nil
+	}
+	if len(clearCallbacks) > 0 {
+		go dispatchClearCallbacks(clearCallbacks)
+		clearCallbacks = nil
+	}
+}
+
+// Wake wakes every goroutine blocked in the package so it re-checks its wait condition,
+// for callers that change external conditions their waiters depend on: goroutines waiting on
+// Cond or for sections to end, those in the wait queue and those blocked by Pause. Wakeups are
+// spurious from the point of view of a waiter whose condition still holds; it simply blocks
+// again, and a queued waiter rejoins the wait queue at the back.
+// It is safe to call concurrently from any goroutine.
+func Wake() {
+	Mu.Lock()
+	Cond.Broadcast()
+	if ch := clearCh.Swap(nil); ch != nil {
+		close(*ch)
+	}
+	for _, w := range waitQueue {
+		if w.state.CompareAndSwap(waiterQueued, waiterReleased) {
+			close(w.ready)
+		}
+	}
+	waitQueue = nil
+	if pauseCh != nil {
+		close(pauseCh)
+		pauseCh = make(chan struct{})
+	}
+	Mu.Unlock()
+}
+
+// clearedChan returns a channel that is closed once no high-priority sections are active.
+// The channel may also be closed by a zero transition that is immediately followed by a new
+// section, so callers must re-check the count after receiving from it.
+//
+// The channel is installed before the count is checked: if the count was still positive,
+// the transition to zero must happen afterwards and will close the installed channel.
+func clearedChan() <-chan struct{} {
+	for {
+		ch := clearCh.Load()
+		if ch == nil {
+			c := make(chan struct{})
+			if !clearCh.CompareAndSwap(nil, &c) {
+				continue
+			}
+			ch = &c
+		}
+		if HighPriorityCount.Load() == 0 {
+			return closedCh
+		}
+		return *ch
+	}
+}
+
+// blockUntilClear blocks the current goroutine until no high-priority sections are active.
+func blockUntilClear() {
+	for HighPriorityCount.Load() > 0 {
+		<-clearedChan()
+	}
+}
+
+// Generation returns the number of times high priority has become active since the process started.
+// Two equal readings with no active sections in between mean no section ran in the meantime.
+func Generation() uint64 {
+	return generation.Load()
+}
+
+// HighPriorityDepth returns the number of currently active high-priority sections.
+func HighPriorityDepth() int {
+	return int(HighPriorityCount.Load())
+}
+
+// HighPriorityWeight returns the total weight of the currently active high-priority sections.
+func HighPriorityWeight() int64 {
+	return activeWeight.Load()
+}
+
+// Waiters returns the number of goroutines currently blocked in WaitIfActive,
+// the blocking phase of WaitIfActiveFast, or WaitIfActiveWithContext.
+func Waiters() int {
+	return int(waiters.Load())
+}
+
 // IsHighPriorityActive returns true if any high-priority sections are currently active.
 func IsHighPriorityActive() bool {
 	return HighPriorityCount.Load() > 0
 }
 
 // WaitIfActive blocks the current goroutine until no high-priority sections are active.
-// This is an efficient blocking operation that uses sync.Cond to avoid busy waiting.
+// This is an efficient blocking operation that waits on a channel closed by the last
+// ExitHighPriority, so waiting goroutines neither poll nor contend on Mu.
+// While the package is paused, it also blocks until Resume is called.
+// With SetGoroutineDepthTracking enabled, a goroutine holding a section itself returns
+// immediately instead of waiting for itself; see SetSelfWaitPanic.
 func WaitIfActive() {
-	for HighPriorityCount.Load() > 0 {
-		Mu.Lock()
-		Cond.Wait()
-		Mu.Unlock()
+	waitIfActive("WaitIfActive")
+}
+
+// WaitIfActiveTimed is like WaitIfActive but returns how long the call was blocked,
+// including any time spent re-blocking after wakeups. It is the Duration of the
+// call's ReasonWaitComplete event, and zero when the call did not block.
+func WaitIfActiveTimed() time.Duration {
+	return waitIfActive("WaitIfActiveTimed")
+}
+
+// waitIfActive implements WaitIfActive for the named entry point and returns the time it was blocked.
+func waitIfActive(entry string) time.Duration {
+	if (HighPriorityCount.Load() == 0 && !paused.Load()) || holdsCeiling() {
+		return 0
+	}
+	if HighPriorityCount.Load() > 0 && selfWait(entry) {
+		return 0
+	}
+
+	traceYieldEvent(ReasonWaitStart, 0)
+	defer endRuntimeRegion(startRuntimeRegion("yieldpoint.WaitIfActive"))
+	var handoff *queuedWaiter
+	defer func() { finishHandoff(handoff) }()
+	start := time.Now()
+	for {
+		handoff = waitUntilClear()
+		if !paused.Load() {
+			break
+		}
+		finishHandoff(handoff)
+		handoff = nil
+		waitWhilePaused()
 	}
+	d := time.Since(start)
+	finishWait(ReasonWaitComplete, d, 0, nil)
+	return d
 }
 
+// waitUntilClear blocks until no high-priority sections are active. It returns the queued
+// waiter whose handoff the caller must finish, if it waited in the queue.
+func waitUntilClear() *queuedWaiter {
+	if HighPriorityCount.Load() == 0 {
+		return nil
+	}
+
+	waiters.Add(1)
+	defer waiters.Add(-1)
+
+	if s := currentWaitStrategy(); s != nil {
+		waitWithStrategy(s)
+		return nil
+	}
+	if queuedWakeups() {
+		return waitQueued()
+	}
+
+	blockUntilClear()
+	return nil
+}
+
+
+// WaitIfActiveLimited is like WaitIfActive, but gives up with ErrTooManyWakeups once it has been
+// woken and found the count positive again more than maxWakeups times. It ignores Pause.
+// The wakeups are reported in the Wakeups field of its completion trace event.
+func WaitIfActiveLimited(maxWakeups int) error {
+	if HighPriorityCount.Load() == 0 || holdsCeiling() || selfWait("WaitIfActiveLimited") {
+		return nil
+	}
+
+	traceYieldEvent(ReasonWaitStart, 0)
+	defer endRuntimeRegion(startRuntimeRegion("yieldpoint.WaitIfActive"))
+	start := time.Now()
+	wakeups, err := waitUntilClearLimited(maxWakeups)
+	finishWait(ReasonWaitComplete, time.Since(start), wakeups, err)
+	return err
+}
+
+// waitUntilClearLimited blocks until no high-priority sections are active or the waiter has been
+// woken in vain more than maxWakeups times, and returns the number of such wakeups.
+func waitUntilClearLimited(maxWakeups int) (int, error) {
+	waiters.Add(1)
+	defer waiters.Add(-1)
+
+	wakeups := 0
+	for {
+		<-clearedChan()
+		if HighPriorityCount.Load() == 0 {
+			return wakeups, nil
+		}
+		wakeups++
+		if wakeups > maxWakeups {
+			return wakeups, ErrTooManyWakeups
+		}
+	}
+}
+
+// WaitForQuiet blocks until no high-priority sections have been active for at least minQuiet.
+// If a new section starts during the quiet period, the wait starts over once it ends.
+func WaitForQuiet(minQuiet time.Duration) {
+	if holdsCeiling() || HighPriorityCount.Load() > 0 && selfWait("WaitForQuiet") {
+		return
+	}
+
+	traceYieldEvent(ReasonWaitStart, 0)
+	start := time.Now()
+	for {
+		blockUntilClear()
+		gen := generation.Load()
+		if HighPriorityCount.Load() > 0 {
+			continue
+		}
+		time.Sleep(minQuiet)
+		if generation.Load() == gen && HighPriorityCount.Load() == 0 {
+			break
+		}
+	}
+	finishWait(ReasonQuietWaitComplete, time.Since(start), 0, nil)
+}
+
+// TryWaitIfActive is the non-blocking counterpart of WaitIfActive.
+// It returns true if no high-priority sections are active and the caller may proceed,
+// and false if one is active and the caller should defer its work.
+func TryWaitIfActive() bool {
+	return HighPriorityCount.Load() == 0
+}
 
 // WaitIfActiveFast is a high-performance version of WaitIfActive that uses a spin-wait
-// strategy before falling back to mutex-based waiting. This is suitable for
+// strategy before falling back to blocking. This is suitable for
 // performance-critical code paths where the wait time is expected to be very short.
+// While the package is paused, it also blocks until Resume is called.
 func WaitIfActiveFast() {
+	if (HighPriorityCount.Load() == 0 && !paused.Load()) || holdsCeiling() {
+		return
+	}
+	if HighPriorityCount.Load() > 0 && selfWait("WaitIfActiveFast") {
+		return
+	}
+
+	traceYieldEvent(ReasonWaitStart, 0)
+	defer endRuntimeRegion(startRuntimeRegion("yieldpoint.WaitIfActive"))
+	var handoff *queuedWaiter
+	defer func() { finishHandoff(handoff) }()
+	start := time.Now()
+	var stage SpinStage
+	for {
+		stage, handoff = waitUntilClearFast()
+		if !paused.Load() {
+			break
+		}
+		finishHandoff(handoff)
+		handoff = nil
+		waitWhilePaused()
+	}
+	d := time.Since(start)
+	recordWait(&fastWaitCount, d)
+	traceEvent(YieldEvent{Reason: ReasonWaitCompleteFast, Duration: d, SpinStage: stage})
+}
+
+// waitUntilClearFast spins and then blocks until no high-priority sections are active,
+// and returns the stage it got to. Like waitUntilClear, it also returns the queued waiter
+// whose handoff the caller must finish.
+func waitUntilClearFast() (SpinStage, *queuedWaiter) {
+	if s := currentWaitStrategy(); s != nil {
+		return SpinStageBlock, waitUntilClear()
+	}
+
 	// First try spin-waiting
-	for range SpinWaitIterations {
-		if HighPriorityCount.Load() == 0 {
-			return
+	if stage := spinUntilClear(); stage != SpinStageBlock {
+		spinResolvedCount.Add(1)
+		return stage, nil
+	}
+	spinFallbackCount.Add(1)
+
+	// Only fall back to blocking if spin-wait didn't succeed
+	waiters.Add(1)
+	defer waiters.Add(-1)
+
+	if queuedWakeups() {
+		return SpinStageBlock, waitQueued()
+	}
+
+	blockUntilClear()
+	return SpinStageBlock, nil
+}
+
+
+// WaitForHighPriority blocks the current goroutine until a high-priority section is active.
+// It is the inverse of WaitIfActive. After Shutdown it returns immediately.
+func WaitForHighPriority() {
+	if HighPriorityCount.Load() > 0 || shutdown.Load() {
+		return
+	}
+
+	traceYieldEvent(ReasonWaitStart, 0)
+	start := time.Now()
+	activationWaiters.Add(1)
+	Mu.Lock()
+	for HighPriorityCount.Load() == 0 && !shutdown.Load() {
+		Cond.Wait()
+	}
+	Mu.Unlock()
+	activationWaiters.Add(-1)
+	finishWait(ReasonActivationWaitComplete, time.Since(start), 0, nil)
+}
+
+// WaitForHighPriorityWithContext is a context-aware version of WaitForHighPriority
+func WaitForHighPriorityWithContext(ctx context.Context) error {
+	if shutdown.Load() {
+		return ErrShutdown
+	}
+	if HighPriorityCount.Load() > 0 {
+		return nil
+	}
+
+	traceYieldEvent(ReasonWaitStart, 0)
+	start := time.Now()
+	err := waitForActivationContext(ctx)
+	finishWait(ReasonActivationWaitComplete, time.Since(start), 0, err)
+	return err
+}
+
+// waitForActivationContext polls until a high-priority section is active or ctx is done.
+func waitForActivationContext(ctx context.Context) error {
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return contextError(ctx)
+		case <-ticker.C:
+			if shutdown.Load() {
+				return ErrShutdown
+			}
+			if HighPriorityCount.Load() > 0 {
+				return nil
+			}
 		}
-		runtime.Gosched()
 	}
+}
+
+// MaybeYieldUntil keeps the current goroutine yielding while high-priority sections are active,
+// giving up once the deadline passes. It returns true if no sections were active when it returned
+// and false if it gave up at the deadline. It wakes as soon as the last section exits.
+func MaybeYieldUntil(deadline time.Time) bool {
+	if HighPriorityCount.Load() == 0 || holdsCeiling() {
+		return true
+	}
+	start := time.Now()
+	runtime.Gosched()
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
 
-	// Only fall back to mutex-based waiting if spin-wait didn't succeed
 	for HighPriorityCount.Load() > 0 {
-		Mu.Lock()
+		select {
+		case <-clearedChan():
+		case <-timer.C:
+			if HighPriorityCount.Load() > 0 {
+				finishWait(ReasonYieldUntilDeadline, time.Since(start), 0, nil)
+				return false
+			}
+		}
+	}
+	finishWait(ReasonYieldUntilCleared, time.Since(start), 0, nil)
+	return true
+}
+
+// MaybeYieldBlocking blocks while high-priority sections are active, but never longer than maxBlock.
+// It returns true if no sections were active when it returned and false if maxBlock elapsed first.
+func MaybeYieldBlocking(maxBlock time.Duration) bool {
+	if HighPriorityCount.Load() == 0 || holdsCeiling() {
+		return true
+	}
+
+	start := time.Now()
+	cleared := blockUntilClearFor(maxBlock)
+	reason := ReasonYieldUntilCleared
+	if !cleared {
+		reason = ReasonYieldUntilDeadline
+	}
+	finishWait(reason, time.Since(start), 0, nil)
+	return cleared
+}
+
+// blockUntilClearFor blocks until no high-priority sections are active or d elapses,
+// and reports whether none were active when it returned.
+func blockUntilClearFor(d time.Duration) bool {
+	waiters.Add(1)
+	defer waiters.Add(-1)
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	for HighPriorityCount.Load() > 0 {
+		select {
+		case <-clearedChan():
+		case <-timer.C:
+			return HighPriorityCount.Load() == 0
+		}
+	}
+	return true
+}
+
+// WaitForDepthBelow blocks the current goroutine until fewer than k high-priority sections are active.
+// WaitIfActive is the special case k=1; values of k below 1 are treated as 1.
+func WaitForDepthBelow(k int) {
+	k = max(k, 1)
+	if HighPriorityDepth() < k || holdsCeiling() {
+		return
+	}
+
+	traceYieldEvent(ReasonWaitStart, 0)
+	start := time.Now()
+	depthWaiters.Add(1)
+	Mu.Lock()
+	for HighPriorityDepth() >= k {
 		Cond.Wait()
-		Mu.Unlock()
 	}
+	Mu.Unlock()
+	depthWaiters.Add(-1)
+	finishWait(ReasonDepthWaitComplete, time.Since(start), 0, nil)
+}
+
+// WaitForDepthBelowWithContext is a context-aware version of WaitForDepthBelow
+func WaitForDepthBelowWithContext(ctx context.Context, k int) error {
+	if shutdown.Load() {
+		return ErrShutdown
+	}
+	k = max(k, 1)
+	if HighPriorityDepth() < k || holdsCeiling() {
+		return nil
+	}
+
+	traceYieldEvent(ReasonWaitStart, 0)
+	start := time.Now()
+	err := waitForDepthBelowContext(ctx, k)
+	finishWait(ReasonDepthWaitComplete, time.Since(start), 0, err)
+	return err
+}
+
+// waitForDepthBelowContext polls until fewer than k sections are active or ctx is done.
+func waitForDepthBelowContext(ctx context.Context, k int) error {
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return contextError(ctx)
+		case <-ticker.C:
+			if shutdown.Load() {
+				return ErrShutdown
+			}
+			if HighPriorityDepth() < k {
+				return nil
+			}
+		}
+	}
+}
+
+// PrioritySleep sleeps for d, but returns early after yielding as soon as a high-priority
+// section is active. The sleep is split into short slices so activation is noticed promptly.
+func PrioritySleep(d time.Duration) {
+	deadline := time.Now().Add(d)
+	for {
+		if HighPriorityCount.Load() > 0 && !holdsCeiling() {
+			runtime.Gosched()
+			return
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return
+		}
+		time.Sleep(min(remaining, prioritySleepSlice))
+	}
+}
+
+// spinUntilClear spins for the configured budget or iteration count and returns the stage
+// in which the high-priority count dropped to zero, or SpinStageBlock if it did not.
+func spinUntilClear() SpinStage {
+	if b := spinBackoff.Load(); b != nil {
+		return b.spin()
+	}
+
+	mode := SpinMode(spinMode.Load())
+	if budget := time.Duration(spinBudget.Load()); budget > 0 {
+		deadline := time.Now().Add(budget)
+		for i := 1; ; i++ {
+			if HighPriorityCount.Load() == 0 {
+				return SpinStageSpin
+			}
+			spinPause(mode, i)
+			if i%spinClockCheckInterval == 0 && time.Now().After(deadline) {
+				return SpinStageBlock
+			}
+		}
+	}
+
+	for i := range int(spinWaitIterations.Load()) {
+		if HighPriorityCount.Load() == 0 {
+			return SpinStageSpin
+		}
+		spinPause(mode, i+1)
+	}
+	return SpinStageBlock
 }
 
+// spinPause is run between the checks of spin iteration i.
+func spinPause(mode SpinMode, i int) {
+	if mode == SpinBusy && i%busySpinGoschedInterval != 0 {
+		return
+	}
+	runtime.Gosched()
+}
 
-// MaybeYieldWithContext is a context-aware version of MaybeYield
+// spin runs the backoff stages and returns the stage in which the high-priority count
+// dropped to zero, or SpinStageBlock if it did not.
+func (b *SpinBackoff) spin() SpinStage {
+	for range b.Spins {
+		if HighPriorityCount.Load() == 0 {
+			return SpinStageSpin
+		}
+	}
+	for range b.Yields {
+		if HighPriorityCount.Load() == 0 {
+			return SpinStageYield
+		}
+		runtime.Gosched()
+	}
+	for _, d := range b.Sleeps {
+		if HighPriorityCount.Load() == 0 {
+			return SpinStageSleep
+		}
+		time.Sleep(d)
+	}
+	if HighPriorityCount.Load() != 0 {
+		return SpinStageBlock
+	}
+	// The final check belongs to the last stage that ran.
+	switch {
+	case len(b.Sleeps) > 0:
+		return SpinStageSleep
+	case b.Yields > 0:
+		return SpinStageYield
+	default:
+		return SpinStageSpin
+	}
+}
+
+// MaybeYieldWithContext is a context-aware version of MaybeYield.
+// When ctx has less than GetDefaultYieldDuration left before its deadline, it skips the yield
+// so the yield itself cannot cause the deadline to be missed. With SetThrottle configured, it
+// applies the duty cycle and returns ctx's error if ctx is done during the sleep.
 func MaybeYieldWithContext(ctx context.Context) error {
 	select {
 	case <-ctx.Done():
-		return ctx.Err()
+		canceledCount.Add(1)
+		traceYieldEvent(ReasonYieldCanceled, 0)
+		return contextError(ctx)
 	default:
-		MaybeYield()
+		if shutdown.Load() {
+			return ErrShutdown
+		}
+		if deadlineTooClose(ctx) {
+			if HighPriorityCount.Load() > 0 {
+				traceYieldEvent(ReasonYieldSuppressed, 0)
+			}
+		} else if err := maybeYieldContext(ctx); err != nil {
+			canceledCount.Add(1)
+			traceYieldEvent(ReasonYieldCanceled, 0)
+			return err
+		}
+		return waitWhilePausedContext(ctx)
+	}
+}
+
+// maybeYieldContext yields like MaybeYieldNonBlocking, applying the duty cycle instead
+// when throttling is on, and returns ctx's error if ctx is done during a throttle sleep.
+func maybeYieldContext(ctx context.Context) error {
+	depth := HighPriorityCount.Load()
+	if depth == 0 || holdsCeiling() || !yieldAllowed(depth) {
 		return nil
 	}
+	if t := throttle.Load(); t != nil {
+		return throttleSleep(ctx, t)
+	}
+	yieldNow()
+	return nil
+}
+
+// deadlineTooClose reports whether ctx's deadline is less than the yield duration away.
+func deadlineTooClose(ctx context.Context) bool {
+	deadline, ok := ctx.Deadline()
+	return ok && time.Until(deadline) < GetDefaultYieldDuration()
 }
 
 // WaitIfActiveWithContext is a context-aware version of WaitIfActive
 func WaitIfActiveWithContext(ctx context.Context) error {
-	ticker := time.NewTicker(time.Millisecond)
-	defer ticker.Stop()
+	_, err := waitIfActiveWithContext(ctx, "WaitIfActiveWithContext")
+	return err
+}
+
+// WaitIfActiveWithContextTimed is like WaitIfActiveWithContext but also returns
+// how long the call was blocked, both on success and on cancellation.
+func WaitIfActiveWithContextTimed(ctx context.Context) (time.Duration, error) {
+	return waitIfActiveWithContext(ctx, "WaitIfActiveWithContextTimed")
+}
+
+// waitIfActiveWithContext implements WaitIfActiveWithContextTimed for the named entry point.
+func waitIfActiveWithContext(ctx context.Context, entry string) (time.Duration, error) {
+	if shutdown.Load() {
+		return 0, ErrShutdown
+	}
+	blocked := HighPriorityCount.Load() > 0 || paused.Load()
+	if blocked && holdsCeiling() {
+		return 0, nil
+	}
+	if HighPriorityCount.Load() > 0 && selfWait(entry) {
+		return 0, nil
+	}
+	if blocked {
+		traceYieldEvent(ReasonWaitStart, 0)
+		defer endRuntimeRegion(startRuntimeRegion("yieldpoint.WaitIfActive"))
+	}
+	start := time.Now()
+	var d time.Duration
+	var handoff *queuedWaiter
+	var err error
+	if blocked && waitProfileLabels.Load() {
+		d, handoff, err = waitIfActiveContextLabeled(ctx, start)
+	} else {
+		d, handoff, err = waitIfActiveContext(ctx, start)
+	}
+	defer finishHandoff(handoff)
+	if blocked {
+		finishWait(ReasonWaitComplete, d, 0, err)
+	}
+	return d, err
+}
 
+// waitIfActiveContext waits out active sections and pauses, returning the time since start
+// and the queued waiter whose handoff the caller must finish.
+func waitIfActiveContext(ctx context.Context, start time.Time) (time.Duration, *queuedWaiter, error) {
 	for {
+		handoff, err := waitUntilClearContext(ctx)
+		if err != nil {
+			return time.Since(start), handoff, err
+		}
+		if shutdown.Load() {
+			return time.Since(start), handoff, ErrShutdown
+		}
+		if !paused.Load() {
+			return time.Since(start), handoff, nil
+		}
+		finishHandoff(handoff)
+		if err := waitWhilePausedContext(ctx); err != nil {
+			return time.Since(start), nil, err
+		}
+	}
+}
+
+// waitUntilClearContext blocks until no high-priority sections are active or ctx is done.
+// Like waitUntilClear, it returns the queued waiter whose handoff the caller must finish.
+func waitUntilClearContext(ctx context.Context) (*queuedWaiter, error) {
+	if HighPriorityCount.Load() == 0 {
+		return nil, nil
+	}
+
+	waiters.Add(1)
+	defer waiters.Add(-1)
+
+	if s := currentWaitStrategy(); s != nil {
+		return nil, waitWithStrategyContext(ctx, s)
+	}
+	if queuedWakeups() {
+		return waitQueuedContext(ctx)
+	}
+
+	for HighPriorityCount.Load() > 0 {
 		select {
 		case <-ctx.Done():
-			return ctx.Err()
-		case <-ticker.C:
-			if HighPriorityCount.Load() == 0 {
-				return nil
-			}
+			return nil, contextError(ctx)
+		case <-clearedChan():
+		}
+	}
+	return nil, nil
+}
+
+// RunCooperative calls body for each i in [0, n), yielding to active high-priority sections
+// before every iteration. It stops at the first error from body or the context.
+// A context that is already done returns its error before body is called.
+func RunCooperative(ctx context.Context, n int, body func(i int) error) error {
+	for i := range n {
+		if err := MaybeYieldWithContext(ctx); err != nil {
+			return err
+		}
+		if err := body(i); err != nil {
+			return err
 		}
 	}
+	return nil
 }
@@ -0,0 +1,381 @@
+package yieldpoint
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// benchReset restores the package defaults before and after a benchmark.
+func benchReset(b *testing.B) {
+	b.Helper()
+	resetPackage()
+	b.Cleanup(resetPackage)
+}
+
+func BenchmarkMaybeYieldIdle(b *testing.B) {
+	benchReset(b)
+	for b.Loop() {
+		MaybeYield()
+	}
+}
+
+func BenchmarkMaybeYieldIdleParallel(b *testing.B) {
+	benchReset(b)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			MaybeYield()
+		}
+	})
+}
+
+func BenchmarkMaybeYieldActive(b *testing.B) {
+	benchReset(b)
+	EnterHighPriority()
+	defer ExitHighPriority()
+	for b.Loop() {
+		MaybeYield()
+	}
+}
+
+func BenchmarkMaybeYieldActiveParallel(b *testing.B) {
+	benchReset(b)
+	EnterHighPriority()
+	defer ExitHighPriority()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			MaybeYield()
+		}
+	})
+}
+
+// BenchmarkYieldLimiterActive compares a hot loop under an active section whose yields
+// sleep for the default yield duration, calling MaybeYield directly and through a limiter.
+func BenchmarkYieldLimiterActive(b *testing.B) {
+	for _, bc := range []struct {
+		name  string
+		yield func()
+	}{
+		{"raw", MaybeYield},
+		{"limited", NewLimiter(10 * time.Millisecond).MaybeYield},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			benchReset(b)
+			SetYieldAction(func() { time.Sleep(GetDefaultYieldDuration()) })
+			EnterHighPriority()
+			defer ExitHighPriority()
+			for b.Loop() {
+				bc.yield()
+			}
+		})
+	}
+}
+
+func BenchmarkYieldLimiterActiveParallel(b *testing.B) {
+	benchReset(b)
+	SetYieldAction(func() { time.Sleep(GetDefaultYieldDuration()) })
+	l := NewLimiter(10 * time.Millisecond)
+	EnterHighPriority()
+	defer ExitHighPriority()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			l.MaybeYield()
+		}
+	})
+}
+
+func BenchmarkMaybeYieldNonBlocking(b *testing.B) {
+	benchReset(b)
+	for b.Loop() {
+		MaybeYieldNonBlocking()
+	}
+}
+
+func BenchmarkMaybeYieldTraced(b *testing.B) {
+	benchReset(b)
+	SetTraceFunc(func(YieldEvent) {})
+	SetYieldAction(func() {})
+	EnterHighPriority()
+	defer ExitHighPriority()
+	for b.Loop() {
+		MaybeYield()
+	}
+}
+
+func BenchmarkMaybeYieldTracedCallers(b *testing.B) {
+	benchReset(b)
+	SetTraceFunc(func(YieldEvent) {})
+	SetTraceCallers(true)
+	SetYieldAction(func() {})
+	EnterHighPriority()
+	defer ExitHighPriority()
+	for b.Loop() {
+		MaybeYield()
+	}
+}
+
+func BenchmarkEnterExit(b *testing.B) {
+	benchReset(b)
+	for b.Loop() {
+		EnterHighPriority()
+		ExitHighPriority()
+	}
+}
+
+func BenchmarkEnterExitParallel(b *testing.B) {
+	benchReset(b)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			EnterHighPriority()
+			ExitHighPriority()
+		}
+	})
+}
+
+func BenchmarkEnterExitTraced(b *testing.B) {
+	benchReset(b)
+	SetTraceFunc(func(YieldEvent) {})
+	for b.Loop() {
+		EnterHighPriority()
+		ExitHighPriority()
+	}
+}
+
+func BenchmarkEnterExitDepthTracking(b *testing.B) {
+	benchReset(b)
+	SetGoroutineDepthTracking(true)
+	for b.Loop() {
+		EnterHighPriority()
+		ExitHighPriority()
+	}
+}
+
+// BenchmarkBroadcastDebounce churns sections from 4 goroutines while 8 goroutines wait in
+// WaitIfActiveLimited. wakeups/op counts the wakeups that found a section active again.
+func BenchmarkBroadcastDebounce(b *testing.B) {
+	for _, debounce := range []time.Duration{0, time.Millisecond} {
+		b.Run(fmt.Sprintf("debounce=%v", debounce), func(b *testing.B) {
+			benchReset(b)
+			SetBroadcastDebounce(debounce)
+			var wakeups atomic.Int64
+			SetTraceFunc(func(e YieldEvent) {
+				if e.Reason == ReasonWaitComplete {
+					wakeups.Add(int64(e.Wakeups))
+				}
+			})
+
+			const numWaiters, numChurners, rounds = 8, 4, 100
+			for b.Loop() {
+				EnterHighPriority()
+				var wg sync.WaitGroup
+				wg.Add(numWaiters + numChurners)
+				for range numWaiters {
+					go func() {
+						defer wg.Done()
+						_ = WaitIfActiveLimited(math.MaxInt)
+					}()
+				}
+				for waiters.Load() < numWaiters {
+					runtime.Gosched()
+				}
+				for range numChurners {
+					go func() {
+						defer wg.Done()
+						for range rounds {
+							EnterHighPriority()
+							runtime.Gosched()
+							ExitHighPriority()
+							runtime.Gosched()
+						}
+					}()
+				}
+				ExitHighPriority()
+				wg.Wait()
+			}
+			b.ReportMetric(float64(wakeups.Load())/float64(b.N), "wakeups/op")
+		})
+	}
+}
+
+func BenchmarkWaitIfActiveFastIdle(b *testing.B) {
+	benchReset(b)
+	for b.Loop() {
+		WaitIfActiveFast()
+	}
+}
+
+func BenchmarkWaitIfActiveFastImmediateClear(b *testing.B) {
+	benchReset(b)
+	for b.Loop() {
+		EnterHighPriority()
+		go ExitHighPriority()
+		WaitIfActiveFast()
+	}
+}
+
+// BenchmarkWaitIfActiveFastSpinMode measures WaitIfActiveFast in each spin mode
+// when the section is exited right away, so the wait is well under a microsecond.
+func BenchmarkWaitIfActiveFastSpinMode(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		mode SpinMode
+	}{
+		{"gosched", SpinGosched},
+		{"busy", SpinBusy},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			benchReset(b)
+			SetSpinMode(bc.mode)
+			for b.Loop() {
+				EnterHighPriority()
+				go ExitHighPriority()
+				WaitIfActiveFast()
+			}
+		})
+	}
+}
+
+func BenchmarkWaitIfActiveImmediateClear(b *testing.B) {
+	benchReset(b)
+	for b.Loop() {
+		EnterHighPriority()
+		go ExitHighPriority()
+		WaitIfActive()
+	}
+}
+
+// BenchmarkWaitIfActiveFastConcurrent blocks 64 WaitIfActiveFast callers on a 200µs section.
+// wake-ns/op is the time from the exit until the last waiter returns, and bg-work/op the
+// progress a background goroutine made meanwhile, which drops as spinning takes over the CPUs.
+func BenchmarkWaitIfActiveFastConcurrent(b *testing.B) {
+	for _, bc := range []struct {
+		name    string
+		backoff *SpinBackoff
+	}{
+		{"spin", nil},
+		{"backoff", &SpinBackoff{Spins: 100, Yields: 10, Sleeps: []time.Duration{time.Microsecond, 10 * time.Microsecond, 100 * time.Microsecond}}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			benchReset(b)
+			SetSpinBackoff(bc.backoff)
+			const numWaiters, hold = 64, 200 * time.Microsecond
+
+			var work atomic.Int64
+			stop := make(chan struct{})
+			defer close(stop)
+			go func() {
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+						work.Add(1)
+						runtime.Gosched()
+					}
+				}
+			}()
+
+			var wake time.Duration
+			for b.Loop() {
+				EnterHighPriority()
+				var wg sync.WaitGroup
+				wg.Add(numWaiters)
+				for range numWaiters {
+					go func() {
+						defer wg.Done()
+						WaitIfActiveFast()
+					}()
+				}
+				time.Sleep(hold)
+				start := time.Now()
+				ExitHighPriority()
+				wg.Wait()
+				wake += time.Since(start)
+			}
+			b.ReportMetric(float64(wake.Nanoseconds())/float64(b.N), "wake-ns/op")
+			b.ReportMetric(float64(work.Load())/float64(b.N), "bg-work/op")
+		})
+	}
+}
+
+// BenchmarkDoHighPriority compares an empty section entered directly and through DoHighPriority,
+// whose difference is the cost of applying and restoring the pprof labels.
+func BenchmarkDoHighPriority(b *testing.B) {
+	ctx := context.Background()
+	fn := func(context.Context) {}
+	b.Run("unlabeled", func(b *testing.B) {
+		benchReset(b)
+		for b.Loop() {
+			EnterHighPriority()
+			fn(ctx)
+			ExitHighPriority()
+		}
+	})
+	b.Run("labeled", func(b *testing.B) {
+		benchReset(b)
+		for b.Loop() {
+			DoHighPriority(ctx, fn)
+		}
+	})
+}
+
+// BenchmarkWaitIfActiveWithContextLabels measures a blocking WaitIfActiveWithContext
+// with and without SetWaitProfileLabels.
+func BenchmarkWaitIfActiveWithContextLabels(b *testing.B) {
+	for _, labeled := range []bool{false, true} {
+		b.Run(fmt.Sprintf("labels=%v", labeled), func(b *testing.B) {
+			benchReset(b)
+			SetWaitProfileLabels(labeled)
+			ctx := context.Background()
+			for b.Loop() {
+				EnterHighPriority()
+				go ExitHighPriority()
+				_ = WaitIfActiveWithContext(ctx)
+			}
+		})
+	}
+}
+
+func BenchmarkGetGoroutineID(b *testing.B) {
+	for b.Loop() {
+		getGoroutineID()
+	}
+}
+
+func BenchmarkMaybeYieldWithContext(b *testing.B) {
+	benchReset(b)
+	ctx := context.Background()
+	for b.Loop() {
+		_ = MaybeYieldWithContext(ctx)
+	}
+}
+
+func BenchmarkChecker(b *testing.B) {
+	benchReset(b)
+	c := NewChecker(context.Background(), 64)
+	for b.Loop() {
+		_ = c.Check()
+	}
+}
+
+func BenchmarkYieldEvery(b *testing.B) {
+	benchReset(b)
+	i := 0
+	for b.Loop() {
+		YieldEvery(i, 64)
+		i++
+	}
+}
+
+func BenchmarkPacer(b *testing.B) {
+	benchReset(b)
+	p := NewPacer(0.01)
+	for b.Loop() {
+		p.Tick()
+	}
+}
@@ -0,0 +1,3225 @@
+package yieldpoint
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+const (
+	// testTimeout bounds how long a test waits for something that should happen
+	testTimeout = 5 * time.Second
+	// blockedFor is how long a goroutine must stay blocked to count as blocked
+	blockedFor = 20 * time.Millisecond
+)
+
+// resetForTest restores the package defaults now and again when t finishes.
+func resetForTest(t *testing.T) {
+	t.Helper()
+	resetPackage()
+	t.Cleanup(resetPackage)
+}
+
+// resetPackage restores every setting, drains all sections and clears the statistics.
+func resetPackage() {
+	SetTraceFunc(nil)
+	StopTraceBatch()
+	SetTraceAsync(0, DropNewest)
+	SetTraceCallers(false)
+	SetTraceStacks()
+	SetTraceSampling(1)
+	SetTraceRateLimit(0)
+	SetTraceSamplingExempt(ReasonEnterHighPriority, ReasonExitHighPriority, ReasonWaitComplete, ReasonWaitCompleteFast,
+		ReasonDepthWaitComplete, ReasonActivationWaitComplete, ReasonQuietWaitComplete)
+	SetTestMode(false)
+	SetThrottle(0, 0)
+	SetWaitStrategy(nil)
+	SetFairWakeups(false)
+	SetWakePolicy(0, 0)
+	SetWakeOne(0)
+	SetYieldAction(nil)
+	SetYieldDecider(nil)
+	SetImbalanceHandler(nil)
+	SetBroadcastDebounce(0)
+	SetGoroutineDepthTracking(false)
+	SetSelfWaitPanic(false)
+	SetGoroutineAccounting(false, 0)
+	SetYieldBudget(0)
+	EnableRuntimeTrace(false)
+	SetWaitProfileLabels(false)
+	SetSpinWaitIterations(DefaultSpinWaitIterations)
+	SetSpinBudget(0)
+	SetSpinMode(SpinGosched)
+	SetSpinBackoff(nil)
+	SetDefaultYieldDuration(time.Millisecond)
+	Resume()
+	shutdown.Store(false)
+
+	Mu.Lock()
+	shutdownCh = make(chan struct{})
+	HighPriorityCount.Store(0)
+	activeWeight.Store(0)
+	markInactive()
+	signalClearLocked()
+	Mu.Unlock()
+
+	labelMu.Lock()
+	clear(activeLabels)
+	clear(openSections)
+	labelMu.Unlock()
+
+	ResetStats()
+}
+
+// goDone runs fn on a new goroutine and returns a channel closed when it returns.
+func goDone(fn func()) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+	return done
+}
+
+// requireDone fails t unless done is closed within testTimeout.
+func requireDone(t *testing.T, done <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatalf("%s did not return", what)
+	}
+}
+
+// requireBlocked fails t if done is closed within blockedFor.
+func requireBlocked(t *testing.T, done <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-done:
+		t.Fatalf("%s returned while it should block", what)
+	case <-time.After(blockedFor):
+	}
+}
+
+// waitUntil polls cond until it holds, failing t after testTimeout.
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(100 * time.Microsecond)
+	}
+}
+
+// queuedLen returns the number of goroutines in the wait queue.
+func queuedLen() int {
+	Mu.Lock()
+	defer Mu.Unlock()
+	return len(waitQueue)
+}
+
+// recordEvents subscribes a Recorder for the duration of t.
+func recordEvents(t *testing.T) *Recorder {
+	t.Helper()
+	r := NewRecorder(1024)
+	t.Cleanup(AddTraceFunc(r.Record))
+	return r
+}
+
+// reasons returns the reasons of events, in order.
+func reasons(events []YieldEvent) []Reason {
+	out := make([]Reason, len(events))
+	for i, e := range events {
+		out[i] = e.Reason
+	}
+	return out
+}
+
+func TestWaitIfActiveReturnsWhenIdle(t *testing.T) {
+	resetForTest(t)
+
+	requireDone(t, goDone(WaitIfActive), "WaitIfActive")
+	requireDone(t, goDone(WaitIfActiveFast), "WaitIfActiveFast")
+	if err := WaitIfActiveWithContext(context.Background()); err != nil {
+		t.Fatalf("WaitIfActiveWithContext: %v", err)
+	}
+	if got := Stats().Waits; got != 0 {
+		t.Fatalf("Waits = %d, want 0 for calls that did not block", got)
+	}
+}
+
+func TestWaitIfActiveBlocksUntilExit(t *testing.T) {
+	resetForTest(t)
+
+	EnterHighPriority()
+	EnterHighPriority()
+	done := goDone(WaitIfActive)
+	requireBlocked(t, done, "WaitIfActive")
+
+	ExitHighPriority()
+	requireBlocked(t, done, "WaitIfActive with one section left")
+
+	ExitHighPriority()
+	requireDone(t, done, "WaitIfActive")
+}
+
+func TestNoMissedWakeups(t *testing.T) {
+	resetForTest(t)
+	SetSpinWaitIterations(0)
+
+	waits := map[string]func(){
+		"WaitIfActive":     WaitIfActive,
+		"WaitIfActiveFast": WaitIfActiveFast,
+		"WaitIfActiveWithContext": func() {
+			_ = WaitIfActiveWithContext(context.Background())
+		},
+	}
+	for name, wait := range waits {
+		t.Run(name, func(t *testing.T) {
+			for range 500 {
+				EnterHighPriority()
+				done := goDone(wait)
+				go ExitHighPriority()
+				requireDone(t, done, name)
+			}
+		})
+	}
+}
+
+func TestGeneration(t *testing.T) {
+	resetForTest(t)
+
+	g := Generation()
+	EnterHighPriority()
+	EnterHighPriority()
+	if got := Generation(); got != g+1 {
+		t.Fatalf("Generation = %d after nested enters, want %d", got, g+1)
+	}
+	ExitHighPriority()
+	ExitHighPriority()
+	EnterHighPriority()
+	defer ExitHighPriority()
+	if got := Generation(); got != g+2 {
+		t.Fatalf("Generation = %d after a new activation, want %d", got, g+2)
+	}
+}
+
+func TestGenerationTraced(t *testing.T) {
+	resetForTest(t)
+	r := recordEvents(t)
+
+	g := Generation()
+	for range 2 {
+		EnterHighPriority()
+		ExitHighPriority()
+	}
+	events := r.Snapshot()
+	if len(events) != 4 {
+		t.Fatalf("recorded %v, want two enters and exits", reasons(events))
+	}
+	for i, e := range events {
+		if want := g + 1 + uint64(i/2); e.Generation != want {
+			t.Fatalf("event %d (%v) has generation %d, want %d", i, e.Reason, e.Generation, want)
+		}
+	}
+}
+
+func TestWeightedSections(t *testing.T) {
+	resetForTest(t)
+	SetTestMode(true)
+
+	EnterHighPriorityWeighted(3)
+	if got := HighPriorityWeight(); got != 3 {
+		t.Fatalf("HighPriorityWeight = %d, want 3", got)
+	}
+	MaybeYieldWeighted(3)
+	if got := YieldIntents(); got != 0 {
+		t.Fatalf("MaybeYieldWeighted(3) yielded at weight 3")
+	}
+	MaybeYieldWeighted(2)
+	if got := YieldIntents(); got != 1 {
+		t.Fatalf("MaybeYieldWeighted(2) did not yield at weight 3")
+	}
+	ExitHighPriorityWeighted(3)
+	if got := HighPriorityWeight(); got != 0 {
+		t.Fatalf("HighPriorityWeight = %d after exit, want 0", got)
+	}
+}
+
+func TestMaybeYieldAbove(t *testing.T) {
+	resetForTest(t)
+	SetTestMode(true)
+
+	EnterHighPriority()
+	EnterHighPriority()
+	defer ExitHighPriority()
+	defer ExitHighPriority()
+
+	MaybeYieldAbove(2)
+	MaybeYieldAbove(1)
+	if got := YieldIntents(); got != 1 {
+		t.Fatalf("YieldIntents = %d, want 1", got)
+	}
+}
+
+func TestMaybeYieldIf(t *testing.T) {
+	resetForTest(t)
+	SetTestMode(true)
+
+	called := false
+	MaybeYieldIf(func() bool { called = true; return true })
+	if called {
+		t.Fatal("predicate called while no section is active")
+	}
+
+	EnterHighPriority()
+	defer ExitHighPriority()
+	MaybeYieldIf(func() bool { return false })
+	MaybeYieldIf(func() bool { return true })
+	if got := YieldIntents(); got != 1 {
+		t.Fatalf("YieldIntents = %d, want 1", got)
+	}
+	if got := Stats().ByReason[ReasonYieldSuppressed]; got != 1 {
+		t.Fatalf("suppressed events = %d, want 1", got)
+	}
+}
+
+func TestYieldEvery(t *testing.T) {
+	resetForTest(t)
+	SetTestMode(true)
+
+	EnterHighPriority()
+	defer ExitHighPriority()
+	for i := range 9 {
+		YieldEvery(i, 3)
+	}
+	if got := YieldIntents(); got != 3 {
+		t.Fatalf("YieldIntents = %d, want 3", got)
+	}
+}
+
+func TestTestModeCountsIntents(t *testing.T) {
+	resetForTest(t)
+
+	var actions atomic.Int32
+	SetYieldAction(func() { actions.Add(1) })
+	SetTestMode(true)
+
+	MaybeYield()
+	if got := YieldIntents(); got != 0 {
+		t.Fatalf("YieldIntents = %d while idle, want 0", got)
+	}
+
+	EnterHighPriority()
+	defer ExitHighPriority()
+	for range 3 {
+		MaybeYield()
+	}
+	if got := YieldIntents(); got != 3 {
+		t.Fatalf("YieldIntents = %d, want 3", got)
+	}
+	if got := actions.Load(); got != 0 {
+		t.Fatalf("yield action called %d times in test mode", got)
+	}
+	if got := Stats().Yields; got != 0 {
+		t.Fatalf("Yields = %d in test mode, want 0", got)
+	}
+
+	SetTestMode(true)
+	if got := YieldIntents(); got != 0 {
+		t.Fatalf("re-enabling test mode left YieldIntents at %d", got)
+	}
+}
+
+func TestYieldDecider(t *testing.T) {
+	resetForTest(t)
+	SetTestMode(true)
+	SetYieldDecider(func(depth int) bool { return depth >= 2 })
+
+	EnterHighPriority()
+	MaybeYield()
+	if got := YieldIntents(); got != 0 {
+		t.Fatalf("yielded at depth 1 against the decider")
+	}
+	if got := Stats().ByReason[ReasonYieldSuppressed]; got != 1 {
+		t.Fatalf("suppressed events = %d, want 1", got)
+	}
+
+	EnterHighPriority()
+	MaybeYieldNonBlocking()
+	if got := YieldIntents(); got != 1 {
+		t.Fatalf("did not yield at depth 2")
+	}
+	ExitHighPriority()
+	ExitHighPriority()
+}
+
+func TestYieldAction(t *testing.T) {
+	resetForTest(t)
+
+	var calls atomic.Int32
+	SetYieldAction(func() { calls.Add(1) })
+	EnterHighPriority()
+	MaybeYield()
+	ExitHighPriority()
+	MaybeYield()
+
+	if got := calls.Load(); got != 1 {
+		t.Fatalf("yield action called %d times, want 1", got)
+	}
+	if got := Stats().Yields; got != 1 {
+		t.Fatalf("Yields = %d, want 1", got)
+	}
+}
+
+func TestTracedYieldDuration(t *testing.T) {
+	resetForTest(t)
+	rec := recordEvents(t)
+	SetYieldAction(func() { time.Sleep(2 * time.Millisecond) })
+
+	EnterHighPriority()
+	MaybeYield()
+	ExitHighPriority()
+
+	for _, e := range rec.Snapshot() {
+		if e.Reason == ReasonHighPriorityActive {
+			if e.Duration < 2*time.Millisecond {
+				t.Fatalf("yield traced with duration %v, want at least 2ms", e.Duration)
+			}
+			return
+		}
+	}
+	t.Fatal("no high_priority_active event")
+}
+
+func TestSetDefaultYieldDuration(t *testing.T) {
+	resetForTest(t)
+
+	for _, tc := range []struct{ in, want time.Duration }{
+		{-time.Second, 0},
+		{0, 0},
+		{time.Nanosecond, time.Nanosecond},
+		{5 * time.Millisecond, 5 * time.Millisecond},
+	} {
+		SetDefaultYieldDuration(tc.in)
+		if got := GetDefaultYieldDuration(); got != tc.want {
+			t.Errorf("SetDefaultYieldDuration(%v): got %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestSpinSettings(t *testing.T) {
+	resetForTest(t)
+
+	SetSpinWaitIterations(-5)
+	if got := GetSpinWaitIterations(); got != 0 {
+		t.Fatalf("GetSpinWaitIterations = %d, want 0", got)
+	}
+	SetSpinBudget(-time.Second)
+	if got := GetSpinBudget(); got != 0 {
+		t.Fatalf("GetSpinBudget = %v, want 0", got)
+	}
+	SetSpinBudget(time.Millisecond)
+	if got := GetSpinBudget(); got != time.Millisecond {
+		t.Fatalf("GetSpinBudget = %v, want 1ms", got)
+	}
+}
+
+func TestSpinBudgetFallbackTime(t *testing.T) {
+	resetForTest(t)
+	const budget = 20 * time.Millisecond
+	SetSpinBudget(budget)
+
+	// Keep the scheduler busy so the spinner's Gosched calls take real time.
+	stop := make(chan struct{})
+	defer close(stop)
+	for range 4 {
+		go func() {
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					runtime.Gosched()
+				}
+			}
+		}()
+	}
+
+	EnterHighPriority()
+	start := time.Now()
+	done := goDone(WaitIfActiveFast)
+	waitUntil(t, "the spinner to fall back", func() bool { return Waiters() == 1 })
+	elapsed := time.Since(start)
+	ExitHighPriority()
+	requireDone(t, done, "WaitIfActiveFast")
+
+	if elapsed < budget/2 || elapsed > budget*3/2 {
+		t.Fatalf("fell back after %v with a %v spin budget, want within 50%%", elapsed, budget)
+	}
+	if _, fallback := SpinStats(); fallback != 1 {
+		t.Fatalf("SpinStats fallbacks = %d, want 1", fallback)
+	}
+}
+
+func TestConfigRace(t *testing.T) {
+	resetForTest(t)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	run := func(fn func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					fn()
+				}
+			}
+		}()
+	}
+
+	run(func() {
+		SetSpinWaitIterations(10)
+		SetSpinWaitIterations(100)
+		_ = GetSpinWaitIterations()
+	})
+	run(func() {
+		SetSpinBudget(10 * time.Microsecond)
+		SetSpinBudget(0)
+		_ = GetSpinBudget()
+	})
+	run(func() {
+		SetDefaultYieldDuration(time.Microsecond)
+		_ = GetDefaultYieldDuration()
+	})
+	run(func() {
+		SetSpinMode(SpinBusy)
+		SetSpinMode(SpinGosched)
+	})
+	run(func() {
+		EnterHighPriority()
+		time.Sleep(10 * time.Microsecond)
+		ExitHighPriority()
+	})
+	run(WaitIfActiveFast)
+	run(MaybeYield)
+
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+}
+
+func TestSpinModes(t *testing.T) {
+	for _, mode := range []SpinMode{SpinGosched, SpinBusy} {
+		resetForTest(t)
+		SetSpinMode(mode)
+		SetSpinBudget(time.Millisecond)
+
+		EnterHighPriority()
+		done := goDone(WaitIfActiveFast)
+		time.Sleep(5 * time.Millisecond)
+		ExitHighPriority()
+		requireDone(t, done, "WaitIfActiveFast")
+	}
+}
+
+func TestSpinBackoff(t *testing.T) {
+	resetForTest(t)
+	SetSpinBackoff(&SpinBackoff{Spins: 10, Yields: 10, Sleeps: []time.Duration{time.Millisecond}})
+
+	EnterHighPriority()
+	done := goDone(WaitIfActiveFast)
+	time.Sleep(5 * time.Millisecond)
+	ExitHighPriority()
+	requireDone(t, done, "WaitIfActiveFast")
+}
+
+func TestSpinStageTraced(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		backoff *SpinBackoff
+		want    SpinStage
+	}{
+		{"spin", nil, SpinStageSpin},
+		{"yield", &SpinBackoff{Yields: 1 << 30}, SpinStageYield},
+		{"sleep", &SpinBackoff{Sleeps: slices.Repeat([]time.Duration{time.Millisecond}, 5000)}, SpinStageSleep},
+		{"block", &SpinBackoff{}, SpinStageBlock},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resetForTest(t)
+			SetSpinBudget(testTimeout)
+			SetSpinBackoff(tc.backoff)
+			r := recordEvents(t)
+
+			EnterHighPriority()
+			done := goDone(WaitIfActiveFast)
+			if tc.want == SpinStageBlock {
+				waitUntil(t, "the waiter to block", func() bool { return Waiters() == 1 })
+			} else {
+				time.Sleep(5 * time.Millisecond)
+			}
+			ExitHighPriority()
+			requireDone(t, done, "WaitIfActiveFast")
+
+			for _, e := range r.Snapshot() {
+				if e.Reason == ReasonWaitStart && e.SpinStage != SpinStageNone {
+					t.Fatalf("wait_start carries spin stage %v", e.SpinStage)
+				}
+				if e.Reason == ReasonWaitCompleteFast && e.SpinStage != tc.want {
+					t.Fatalf("wait_complete_fast spin stage = %v, want %v", e.SpinStage, tc.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSpinStats(t *testing.T) {
+	resetForTest(t)
+
+	SetSpinBudget(testTimeout)
+	EnterHighPriority()
+	done := goDone(WaitIfActiveFast)
+	time.Sleep(5 * time.Millisecond)
+	ExitHighPriority()
+	requireDone(t, done, "WaitIfActiveFast")
+
+	if resolved, fallback := SpinStats(); resolved != 1 || fallback != 0 {
+		t.Fatalf("SpinStats = (%d, %d) after a resolved spin, want (1, 0)", resolved, fallback)
+	}
+
+	SetSpinBudget(0)
+	SetSpinWaitIterations(0)
+	EnterHighPriority()
+	done = goDone(WaitIfActiveFast)
+	waitUntil(t, "the waiter to block", func() bool { return Waiters() == 1 })
+	ExitHighPriority()
+	requireDone(t, done, "WaitIfActiveFast")
+
+	if resolved, fallback := SpinStats(); resolved != 1 || fallback != 1 {
+		t.Fatalf("SpinStats = (%d, %d) after a fallback, want (1, 1)", resolved, fallback)
+	}
+	s := Stats()
+	if s.SpinResolved != 1 || s.SpinFallbacks != 1 {
+		t.Fatalf("Stats spin counts = (%d, %d), want (1, 1)", s.SpinResolved, s.SpinFallbacks)
+	}
+
+	ResetStats()
+	if resolved, fallback := SpinStats(); resolved != 0 || fallback != 0 {
+		t.Fatalf("SpinStats = (%d, %d) after ResetStats", resolved, fallback)
+	}
+}
+
+func TestWaitStrategies(t *testing.T) {
+	strategies := map[string]WaitStrategy{
+		"BlockImmediately": BlockImmediately{},
+		"SpinThenBlock":    SpinThenBlock{Iterations: 3},
+		"BackoffStrategy":  BackoffStrategy{Initial: 100 * time.Microsecond, Max: time.Millisecond},
+	}
+	for name, s := range strategies {
+		t.Run(name, func(t *testing.T) {
+			resetForTest(t)
+			SetWaitStrategy(s)
+
+			EnterHighPriority()
+			done := goDone(WaitIfActive)
+			ctxDone := goDone(func() { _ = WaitIfActiveWithContext(context.Background()) })
+			requireBlocked(t, done, "WaitIfActive")
+			ExitHighPriority()
+			requireDone(t, done, "WaitIfActive")
+			requireDone(t, ctxDone, "WaitIfActiveWithContext")
+		})
+	}
+}
+
+func TestBackoffStrategyNext(t *testing.T) {
+	s := BackoffStrategy{Initial: time.Millisecond, Max: 4 * time.Millisecond, MaxAttempts: 4}
+	want := []time.Duration{time.Millisecond, 2 * time.Millisecond, 4 * time.Millisecond, 4 * time.Millisecond}
+	for i, w := range want {
+		if d, block := s.Next(i); d != w || block {
+			t.Fatalf("Next(%d) = (%v, %v), want (%v, false)", i, d, block, w)
+		}
+	}
+	if _, block := s.Next(4); !block {
+		t.Fatal("Next(MaxAttempts) did not block")
+	}
+}
+
+func TestWaitIfActiveWithContextErrors(t *testing.T) {
+	resetForTest(t)
+	EnterHighPriority()
+	defer ExitHighPriority()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	err := WaitIfActiveWithContext(ctx)
+	if !errors.Is(err, ErrTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("timed out wait returned %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(5*time.Millisecond, cancel)
+	d, err := WaitIfActiveWithContextTimed(ctx)
+	if !errors.Is(err, ErrCancelled) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled wait returned %v", err)
+	}
+	if d <= 0 {
+		t.Fatalf("cancelled wait reported %v blocked", d)
+	}
+	if got := Stats().Canceled; got != 2 {
+		t.Fatalf("Canceled = %d, want 2", got)
+	}
+}
+
+func TestMaybeYieldWithContext(t *testing.T) {
+	resetForTest(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := MaybeYieldWithContext(ctx); !errors.Is(err, ErrCancelled) {
+		t.Fatalf("MaybeYieldWithContext with a cancelled context returned %v", err)
+	}
+	if err := MaybeYieldWithContext(context.Background()); err != nil {
+		t.Fatalf("MaybeYieldWithContext: %v", err)
+	}
+}
+
+func TestMaybeYieldWithContextSkipsNearDeadline(t *testing.T) {
+	resetForTest(t)
+	SetTestMode(true)
+	SetDefaultYieldDuration(time.Minute)
+
+	EnterHighPriority()
+	defer ExitHighPriority()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := MaybeYieldWithContext(ctx); err != nil {
+		t.Fatalf("MaybeYieldWithContext: %v", err)
+	}
+	if got := YieldIntents(); got != 0 {
+		t.Fatalf("yielded with the deadline closer than the yield duration")
+	}
+	if got := Stats().ByReason[ReasonYieldSuppressed]; got != 1 {
+		t.Fatalf("suppressed events = %d, want 1", got)
+	}
+
+	SetDefaultYieldDuration(time.Millisecond)
+	if err := MaybeYieldWithContext(ctx); err != nil {
+		t.Fatalf("MaybeYieldWithContext: %v", err)
+	}
+	if got := YieldIntents(); got != 1 {
+		t.Fatalf("did not yield with the deadline far away")
+	}
+}
+
+func TestChecker(t *testing.T) {
+	resetForTest(t)
+	SetTestMode(true)
+
+	EnterHighPriority()
+	defer ExitHighPriority()
+
+	c := NewChecker(context.Background(), 4)
+	for range 8 {
+		if err := c.Check(); err != nil {
+			t.Fatalf("Check: %v", err)
+		}
+	}
+	if got := YieldIntents(); got != 2 {
+		t.Fatalf("YieldIntents = %d after 8 checks every 4, want 2", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c = NewChecker(ctx, 2)
+	if err := c.Check(); err != nil {
+		t.Fatalf("first Check consulted the context: %v", err)
+	}
+	if err := c.Check(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("due Check returned %v, want context.Canceled", err)
+	}
+}
+
+func TestRunCooperative(t *testing.T) {
+	resetForTest(t)
+
+	var calls []int
+	if err := RunCooperative(context.Background(), 3, func(i int) error {
+		calls = append(calls, i)
+		return nil
+	}); err != nil {
+		t.Fatalf("RunCooperative: %v", err)
+	}
+	if !slices.Equal(calls, []int{0, 1, 2}) {
+		t.Fatalf("body called with %v", calls)
+	}
+
+	errStop := errors.New("stop")
+	n := 0
+	err := RunCooperative(context.Background(), 10, func(i int) error {
+		n++
+		if i == 1 {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop || n != 2 {
+		t.Fatalf("RunCooperative = %v after %d calls, want errStop after 2", err, n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := RunCooperative(ctx, 1, func(int) error {
+		t.Fatal("body called with a done context")
+		return nil
+	}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("RunCooperative with a done context returned %v", err)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	resetForTest(t)
+	SetTestMode(true)
+
+	l := NewLimiter(time.Hour)
+	l.MaybeYield()
+	if got := YieldIntents(); got != 0 {
+		t.Fatal("limiter yielded while idle")
+	}
+
+	EnterHighPriority()
+	defer ExitHighPriority()
+	for range 10 {
+		l.MaybeYield()
+	}
+	if got := YieldIntents(); got != 1 {
+		t.Fatalf("YieldIntents = %d, want 1 per interval", got)
+	}
+}
+
+func TestPrioritySleep(t *testing.T) {
+	resetForTest(t)
+
+	start := time.Now()
+	PrioritySleep(20 * time.Millisecond)
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Fatalf("idle PrioritySleep returned after %v", d)
+	}
+
+	done := goDone(func() { PrioritySleep(time.Hour) })
+	time.Sleep(5 * time.Millisecond)
+	EnterHighPriority()
+	defer ExitHighPriority()
+	requireDone(t, done, "PrioritySleep after activation")
+}
+
+func TestWaitForDepthBelow(t *testing.T) {
+	resetForTest(t)
+
+	for range 3 {
+		EnterHighPriority()
+	}
+	done := goDone(func() { WaitForDepthBelow(2) })
+	requireBlocked(t, done, "WaitForDepthBelow at depth 3")
+	ExitHighPriority()
+	requireBlocked(t, done, "WaitForDepthBelow at depth 2")
+	ExitHighPriority()
+	requireDone(t, done, "WaitForDepthBelow at depth 1")
+	ExitHighPriority()
+
+	EnterHighPriority()
+	defer ExitHighPriority()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	if err := WaitForDepthBelowWithContext(ctx, 1); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("WaitForDepthBelowWithContext returned %v, want ErrTimeout", err)
+	}
+	if err := WaitForDepthBelowWithContext(context.Background(), 2); err != nil {
+		t.Fatalf("WaitForDepthBelowWithContext below the depth: %v", err)
+	}
+}
+
+func TestWaitForHighPriority(t *testing.T) {
+	resetForTest(t)
+
+	done := goDone(WaitForHighPriority)
+	requireBlocked(t, done, "WaitForHighPriority")
+	EnterHighPriority()
+	requireDone(t, done, "WaitForHighPriority")
+	requireDone(t, goDone(WaitForHighPriority), "WaitForHighPriority while active")
+	ExitHighPriority()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(5*time.Millisecond, cancel)
+	if err := WaitForHighPriorityWithContext(ctx); !errors.Is(err, ErrCancelled) {
+		t.Fatalf("WaitForHighPriorityWithContext returned %v, want ErrCancelled", err)
+	}
+}
+
+func TestWaitForQuiet(t *testing.T) {
+	resetForTest(t)
+
+	EnterHighPriority()
+	start := time.Now()
+	done := goDone(func() { WaitForQuiet(20 * time.Millisecond) })
+	time.Sleep(5 * time.Millisecond)
+	ExitHighPriority()
+	requireDone(t, done, "WaitForQuiet")
+	if d := time.Since(start); d < 25*time.Millisecond {
+		t.Fatalf("WaitForQuiet returned %v after start, before the quiet period", d)
+	}
+}
+
+func TestMaybeYieldUntil(t *testing.T) {
+	resetForTest(t)
+
+	if !MaybeYieldUntil(time.Now()) {
+		t.Fatal("MaybeYieldUntil returned false while idle")
+	}
+
+	EnterHighPriority()
+	if MaybeYieldUntil(time.Now().Add(5 * time.Millisecond)) {
+		t.Fatal("MaybeYieldUntil returned true with a section still active")
+	}
+	time.AfterFunc(5*time.Millisecond, ExitHighPriority)
+	if !MaybeYieldUntil(time.Now().Add(testTimeout)) {
+		t.Fatal("MaybeYieldUntil returned false after the section ended")
+	}
+}
+
+func TestMaybeYieldBlocking(t *testing.T) {
+	resetForTest(t)
+
+	EnterHighPriority()
+	if MaybeYieldBlocking(5 * time.Millisecond) {
+		t.Fatal("MaybeYieldBlocking returned true with a section still active")
+	}
+	time.AfterFunc(5*time.Millisecond, ExitHighPriority)
+	if !MaybeYieldBlocking(testTimeout) {
+		t.Fatal("MaybeYieldBlocking returned false after the section ended")
+	}
+}
+
+func TestWaitIfActiveTimed(t *testing.T) {
+	resetForTest(t)
+	rec := recordEvents(t)
+
+	if d := WaitIfActiveTimed(); d != 0 {
+		t.Fatalf("WaitIfActiveTimed while idle = %v, want 0", d)
+	}
+
+	EnterHighPriority()
+	result := make(chan time.Duration, 1)
+	go func() { result <- WaitIfActiveTimed() }()
+	waitUntil(t, "the waiter to block", func() bool { return Waiters() == 1 })
+	time.Sleep(5 * time.Millisecond)
+	ExitHighPriority()
+
+	var d time.Duration
+	select {
+	case d = <-result:
+	case <-time.After(testTimeout):
+		t.Fatal("WaitIfActiveTimed did not return")
+	}
+	if d < 5*time.Millisecond {
+		t.Fatalf("WaitIfActiveTimed = %v, want at least 5ms", d)
+	}
+	events := rec.Snapshot()
+	if last := events[len(events)-1]; last.Reason != ReasonWaitComplete || last.Duration != d {
+		t.Fatalf("last event = %v with Duration %v, want wait_complete with %v", last.Reason, last.Duration, d)
+	}
+}
+
+func TestWaitIfActiveLimited(t *testing.T) {
+	resetForTest(t)
+	rec := recordEvents(t)
+
+	if err := WaitIfActiveLimited(0); err != nil {
+		t.Fatalf("WaitIfActiveLimited while idle: %v", err)
+	}
+
+	EnterHighPriority()
+	done := make(chan error, 1)
+	go func() { done <- WaitIfActiveLimited(0) }()
+	defer ExitHighPriority()
+
+	// Keep waking the waiter while the count is still positive.
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case err := <-done:
+			if !errors.Is(err, ErrTooManyWakeups) {
+				t.Fatalf("WaitIfActiveLimited returned %v, want ErrTooManyWakeups", err)
+			}
+			if s := Stats(); s.Waits != 1 || s.Canceled != 1 {
+				t.Fatalf("Waits = %d, Canceled = %d, want 1 and 1", s.Waits, s.Canceled)
+			}
+			events := rec.Snapshot()
+			if last := events[len(events)-1]; last.Reason != ReasonWaitCanceled || last.Wakeups != 1 {
+				t.Fatalf("last event = %v with %d wakeups, want WaitCanceled with 1", last.Reason, last.Wakeups)
+			}
+			return
+		case <-ticker.C:
+			Wake()
+		case <-timeout:
+			t.Fatal("WaitIfActiveLimited did not give up")
+		}
+	}
+}
+
+func TestTryWaitIfActive(t *testing.T) {
+	resetForTest(t)
+
+	if !TryWaitIfActive() {
+		t.Fatal("TryWaitIfActive = false while idle")
+	}
+	EnterHighPriority()
+	if TryWaitIfActive() {
+		t.Fatal("TryWaitIfActive = true while active")
+	}
+	ExitHighPriority()
+}
+
+func TestWaitersGaugeWithCancellation(t *testing.T) {
+	modes := map[string]func(){
+		"broadcast":   func() {},
+		"fair":        func() { SetFairWakeups(true) },
+		"wake_policy": func() { SetWakePolicy(2, 0) },
+	}
+	for name, setup := range modes {
+		t.Run(name, func(t *testing.T) {
+			resetForTest(t)
+			setup()
+			EnterHighPriority()
+
+			const n = 10
+			cancels := make([]context.CancelFunc, n)
+			errs := make(chan error, n)
+			for i := range n {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancels[i] = cancel
+				go func() { errs <- WaitIfActiveWithContext(ctx) }()
+			}
+			waitUntil(t, "all waiters to block", func() bool { return Waiters() == n })
+
+			for _, cancel := range cancels[:n/2] {
+				cancel()
+			}
+			waitUntil(t, "cancelled waiters to leave", func() bool { return Waiters() == n/2 })
+
+			ExitHighPriority()
+			var cancelled int
+			for range n {
+				select {
+				case err := <-errs:
+					if errors.Is(err, ErrCancelled) {
+						cancelled++
+					} else if err != nil {
+						t.Fatalf("WaitIfActiveWithContext: %v", err)
+					}
+				case <-time.After(testTimeout):
+					t.Fatal("waiters did not return")
+				}
+			}
+			if cancelled != n/2 {
+				t.Fatalf("%d waits cancelled, want %d", cancelled, n/2)
+			}
+			if got := Waiters(); got != 0 {
+				t.Fatalf("Waiters = %d after all returned", got)
+			}
+			for _, cancel := range cancels {
+				cancel()
+			}
+		})
+	}
+}
+
+func TestFairWakeupsReleaseAll(t *testing.T) {
+	resetForTest(t)
+	SetFairWakeups(true)
+
+	EnterHighPriority()
+	var dones []<-chan struct{}
+	for range 5 {
+		dones = append(dones, goDone(WaitIfActive))
+	}
+	waitUntil(t, "all waiters to queue", func() bool { return queuedLen() == 5 })
+	ExitHighPriority()
+	for _, done := range dones {
+		requireDone(t, done, "fair waiter")
+	}
+}
+
+func TestFairWakeupsFIFOAcrossCycles(t *testing.T) {
+	resetForTest(t)
+	SetFairWakeups(true)
+
+	const numWaiters, cycles = 50, 50
+
+	var mu sync.Mutex
+	var completed []uint64
+	SetTraceFunc(func(e YieldEvent) {
+		if e.Reason == ReasonWaitComplete {
+			mu.Lock()
+			completed = append(completed, e.GoroutineID)
+			mu.Unlock()
+		}
+	})
+
+	// Persistent waiters call WaitIfActive once per turn they are given.
+	ids := make([]uint64, numWaiters)
+	turns := make([]chan struct{}, numWaiters)
+	finished := make(chan struct{}, numWaiters)
+	var wg sync.WaitGroup
+	for i := range numWaiters {
+		turns[i] = make(chan struct{})
+		started := make(chan struct{})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ids[i] = getGoroutineID()
+			close(started)
+			for range turns[i] {
+				WaitIfActive()
+				finished <- struct{}{}
+			}
+		}()
+		<-started
+	}
+	defer func() {
+		for _, turn := range turns {
+			close(turn)
+		}
+		wg.Wait()
+	}()
+
+	for c := range cycles {
+		mu.Lock()
+		completed = completed[:0]
+		mu.Unlock()
+
+		// Each cycle queues the waiters in a different order.
+		EnterHighPriority()
+		want := make([]uint64, numWaiters)
+		for j := range numWaiters {
+			i := (j*7 + c) % numWaiters
+			want[j] = ids[i]
+			turns[i] <- struct{}{}
+			waitUntil(t, "the waiter to queue", func() bool { return queuedLen() == j+1 })
+		}
+		ExitHighPriority()
+		for range numWaiters {
+			select {
+			case <-finished:
+			case <-time.After(testTimeout):
+				t.Fatalf("cycle %d: fair waiters did not all return", c)
+			}
+		}
+
+		mu.Lock()
+		got := slices.Clone(completed)
+		mu.Unlock()
+		if !slices.Equal(got, want) {
+			t.Fatalf("cycle %d: waiters completed in order %v, want arrival order %v", c, got, want)
+		}
+	}
+}
+
+func TestWakeOneChainOrder(t *testing.T) {
+	resetForTest(t)
+	SetWakeOne(testTimeout)
+
+	EnterHighPriority()
+	var mu sync.Mutex
+	var order []int
+	var dones []<-chan struct{}
+	for i := range 5 {
+		dones = append(dones, goDone(func() {
+			WaitIfActive()
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+			ReleaseNext()
+		}))
+		waitUntil(t, "the waiter to queue", func() bool { return queuedLen() == i+1 })
+	}
+	ExitHighPriority()
+	for _, done := range dones {
+		requireDone(t, done, "chained waiter")
+	}
+	if !slices.Equal(order, []int{0, 1, 2, 3, 4}) {
+		t.Fatalf("waiters released in order %v", order)
+	}
+}
+
+func TestWakePolicyBatches(t *testing.T) {
+	resetForTest(t)
+	SetWakePolicy(2, 20*time.Millisecond)
+
+	EnterHighPriority()
+	var dones []<-chan struct{}
+	for range 6 {
+		dones = append(dones, goDone(WaitIfActive))
+	}
+	waitUntil(t, "all waiters to queue", func() bool { return queuedLen() == 6 })
+
+	start := time.Now()
+	ExitHighPriority()
+	for _, done := range dones {
+		requireDone(t, done, "batched waiter")
+	}
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Fatalf("3 batches with a 20ms gap released in %v", d)
+	}
+}
+
+func TestWakePolicyRamp(t *testing.T) {
+	resetForTest(t)
+	const numWaiters, batch, gap = 500, 50, 10 * time.Millisecond
+	SetWakePolicy(batch, gap)
+
+	EnterHighPriority()
+	released := make(chan time.Time, numWaiters)
+	for range numWaiters {
+		go func() {
+			WaitIfActive()
+			released <- time.Now()
+		}()
+	}
+	waitUntil(t, "all waiters to queue", func() bool { return queuedLen() == numWaiters })
+
+	start := time.Now()
+	ExitHighPriority()
+	offsets := make([]time.Duration, 0, numWaiters)
+	for range numWaiters {
+		select {
+		case at := <-released:
+			offsets = append(offsets, at.Sub(start))
+		case <-time.After(testTimeout):
+			t.Fatalf("only %d of %d waiters released", len(offsets), numWaiters)
+		}
+	}
+	slices.Sort(offsets)
+
+	// At most one batch is released per gap, so the i-th release cannot come before
+	// its batch's gap, and the releases spread over all the gaps instead of one spike.
+	for i, d := range offsets {
+		if min := time.Duration(i/batch) * gap; d < min {
+			t.Fatalf("release %d came after %v, before its batch's %v", i, d, min)
+		}
+	}
+	if spread, want := offsets[numWaiters-1]-offsets[0], (numWaiters/batch-2)*gap; spread < want {
+		t.Fatalf("releases spread over %v, want a ramp of at least %v", spread, want)
+	}
+}
+
+func TestWakePolicySkipsCancelledWaiters(t *testing.T) {
+	resetForTest(t)
+	const gap = 100 * time.Millisecond
+	SetWakePolicy(2, gap)
+
+	// Waiters 2 and 3 would form the second batch but are cancelled while it is pending.
+	EnterHighPriority()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	released := make([]chan time.Time, 6)
+	errs := make(chan error, 2)
+	for i := range released {
+		released[i] = make(chan time.Time, 1)
+		go func() {
+			if i == 2 || i == 3 {
+				errs <- WaitIfActiveWithContext(ctx)
+				return
+			}
+			WaitIfActive()
+			released[i] <- time.Now()
+		}()
+		waitUntil(t, "the waiter to queue", func() bool { return queuedLen() == i+1 })
+	}
+
+	start := time.Now()
+	ExitHighPriority()
+	cancel()
+	for range 2 {
+		if err := <-errs; !errors.Is(err, ErrCancelled) {
+			t.Fatalf("cancelled waiter returned %v, want ErrCancelled", err)
+		}
+	}
+	for _, i := range []int{0, 1, 4, 5} {
+		var d time.Duration
+		select {
+		case at := <-released[i]:
+			d = at.Sub(start)
+		case <-time.After(testTimeout):
+			t.Fatalf("waiter %d was not released", i)
+		}
+		// The cancelled waiters do not count toward a batch, so 4 and 5 go out after one gap.
+		if first := i < 2; first && d >= gap || !first && (d < gap || d >= 2*gap) {
+			t.Fatalf("waiter %d released after %v with a %v gap", i, d, gap)
+		}
+	}
+}
+
+func TestBroadcastDebounce(t *testing.T) {
+	resetForTest(t)
+	SetBroadcastDebounce(50 * time.Millisecond)
+
+	EnterHighPriority()
+	done := goDone(WaitIfActive)
+	waitUntil(t, "the waiter to block", func() bool { return Waiters() == 1 })
+
+	ExitHighPriority()
+	EnterHighPriority()
+	select {
+	case <-done:
+		t.Fatal("waiter woken by an exit followed by an enter within the debounce window")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	ExitHighPriority()
+	requireDone(t, done, "WaitIfActive after a debounced exit")
+}
+
+func TestImbalanceHandler(t *testing.T) {
+	resetForTest(t)
+
+	var deltas []int
+	SetImbalanceHandler(func(delta int) { deltas = append(deltas, delta) })
+	ExitHighPriority()
+	if !slices.Equal(deltas, []int{1}) {
+		t.Fatalf("handler called with %v, want [1]", deltas)
+	}
+	if got := HighPriorityDepth(); got != 0 {
+		t.Fatalf("HighPriorityDepth = %d after an unbalanced exit", got)
+	}
+}
+
+func TestOnClear(t *testing.T) {
+	resetForTest(t)
+
+	ran := false
+	OnClear(func() { ran = true })
+	if !ran {
+		t.Fatal("OnClear did not run fn immediately while idle")
+	}
+
+	EnterHighPriority()
+	fired := make(chan struct{})
+	OnClear(func() { close(fired) })
+	var cancelled atomic.Bool
+	cancel := OnClear(func() { cancelled.Store(true) })
+	cancel()
+	cancel()
+	ExitHighPriority()
+
+	requireDone(t, fired, "OnClear callback")
+	time.Sleep(blockedFor)
+	if cancelled.Load() {
+		t.Fatal("cancelled OnClear callback ran")
+	}
+}
+
+func TestOnClearStress(t *testing.T) {
+	resetForTest(t)
+
+	const rounds = 500
+	var fired, raced atomic.Int32
+	for range rounds {
+		EnterHighPriority()
+		var once atomic.Int32
+		OnClear(func() { fired.Add(1) })
+		cancel := OnClear(func() {
+			if once.Add(1) > 1 {
+				t.Error("OnClear callback ran twice")
+			}
+			raced.Add(1)
+		})
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() { defer wg.Done(); ExitHighPriority() }()
+		go func() { defer wg.Done(); cancel() }()
+		wg.Wait()
+	}
+
+	waitUntil(t, "every uncancelled callback", func() bool { return fired.Load() == rounds })
+	if got := raced.Load(); got > rounds {
+		t.Fatalf("%d racing callbacks ran in %d rounds", got, rounds)
+	}
+}
+
+func TestPause(t *testing.T) {
+	resetForTest(t)
+
+	Pause()
+	Pause()
+	if !IsPaused() {
+		t.Fatal("IsPaused = false after Pause")
+	}
+	MaybeYieldNonBlocking()
+
+	done := goDone(MaybeYield)
+	wait := goDone(WaitIfActive)
+	requireBlocked(t, done, "MaybeYield while paused")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	if err := MaybeYieldWithContext(ctx); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("MaybeYieldWithContext while paused returned %v", err)
+	}
+
+	Resume()
+	Resume()
+	requireDone(t, done, "MaybeYield after Resume")
+	requireDone(t, wait, "WaitIfActive after Resume")
+}
+
+func TestShutdown(t *testing.T) {
+	resetForTest(t)
+
+	EnterHighPriority()
+	EnterHighPriority()
+	dones := []<-chan struct{}{
+		goDone(WaitIfActive),
+		goDone(WaitIfActiveFast),
+		goDone(func() { WaitForDepthBelow(1) }),
+	}
+	errs := make(chan error, 1)
+	go func() { errs <- WaitIfActiveWithContext(context.Background()) }()
+	waitUntil(t, "the waiters to block", func() bool { return Waiters() >= 2 })
+
+	Shutdown()
+	Shutdown()
+	if !IsShutdown() {
+		t.Fatal("IsShutdown = false after Shutdown")
+	}
+	for _, done := range dones {
+		requireDone(t, done, "waiter after Shutdown")
+	}
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrShutdown) {
+			t.Fatalf("WaitIfActiveWithContext returned %v, want ErrShutdown", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("WaitIfActiveWithContext did not return after Shutdown")
+	}
+
+	EnterHighPriority()
+	if got := HighPriorityDepth(); got != 0 {
+		t.Fatalf("HighPriorityDepth = %d after an enter following Shutdown", got)
+	}
+	if err := MaybeYieldWithContext(context.Background()); !errors.Is(err, ErrShutdown) {
+		t.Fatalf("MaybeYieldWithContext returned %v, want ErrShutdown", err)
+	}
+	requireDone(t, goDone(WaitForHighPriority), "WaitForHighPriority after Shutdown")
+}
+
+func TestEnterAfterShutdown(t *testing.T) {
+	resetForTest(t)
+	Shutdown()
+	rec := recordEvents(t)
+
+	gen, active := Generation(), ActiveTime()
+	EnterHighPriorityWeighted(3)
+	if got := Generation(); got != gen {
+		t.Fatalf("Generation = %d after an enter following Shutdown, want %d", got, gen)
+	}
+	if got := reasons(rec.Snapshot()); len(got) != 0 {
+		t.Fatalf("events = %v for an enter following Shutdown, want none", got)
+	}
+	if IsHighPriorityActive() || ActiveTime() != active {
+		t.Fatal("an enter following Shutdown opened an active period")
+	}
+}
+
+func TestShutdownContextFunctions(t *testing.T) {
+	resetForTest(t)
+	Shutdown()
+	rec := recordEvents(t)
+
+	ctx := context.Background()
+	calls := map[string]func() error{
+		"MaybeYieldWithContext":          func() error { return MaybeYieldWithContext(ctx) },
+		"WaitIfActiveWithContext":        func() error { return WaitIfActiveWithContext(ctx) },
+		"WaitForHighPriorityWithContext": func() error { return WaitForHighPriorityWithContext(ctx) },
+		"WaitForDepthBelowWithContext":   func() error { return WaitForDepthBelowWithContext(ctx, 1) },
+	}
+	for name, call := range calls {
+		start := time.Now()
+		if err := call(); !errors.Is(err, ErrShutdown) {
+			t.Fatalf("%s after Shutdown returned %v, want ErrShutdown", name, err)
+		}
+		if d := time.Since(start); d > blockedFor {
+			t.Fatalf("%s after Shutdown took %v", name, d)
+		}
+	}
+	if d, err := WaitIfActiveWithContextTimed(ctx); d != 0 || !errors.Is(err, ErrShutdown) {
+		t.Fatalf("WaitIfActiveWithContextTimed after Shutdown = %v, %v", d, err)
+	}
+	if s := Stats(); s.Waits != 0 || s.Canceled != 0 {
+		t.Fatalf("Waits = %d, Canceled = %d after Shutdown, want no wait accounting", s.Waits, s.Canceled)
+	}
+	if got := reasons(rec.Snapshot()); len(got) != 0 {
+		t.Fatalf("events after Shutdown = %v, want none", got)
+	}
+}
+
+func TestShutdownReleasesQueuedWaiters(t *testing.T) {
+	modes := map[string]func(){
+		"wake-one chain": func() { SetWakeOne(time.Hour) },
+		"wake policy":    func() { SetWakePolicy(1, time.Hour) },
+		"fair":           func() { SetFairWakeups(true) },
+	}
+	for name, setup := range modes {
+		t.Run(name, func(t *testing.T) {
+			resetForTest(t)
+			setup()
+
+			EnterHighPriority()
+			var dones []<-chan struct{}
+			for i := range 3 {
+				dones = append(dones, goDone(WaitIfActive))
+				waitUntil(t, "the waiter to queue", func() bool { return queuedLen() == i+1 })
+			}
+			Shutdown()
+			for _, done := range dones {
+				requireDone(t, done, "queued waiter after Shutdown")
+			}
+		})
+	}
+}
+
+func TestWake(t *testing.T) {
+	resetForTest(t)
+
+	var ready atomic.Bool
+	done := goDone(func() {
+		Mu.Lock()
+		for !ready.Load() {
+			Cond.Wait()
+		}
+		Mu.Unlock()
+	})
+	requireBlocked(t, done, "custom predicate waiter")
+	ready.Store(true)
+	Wake()
+	requireDone(t, done, "custom predicate waiter after Wake")
+
+	EnterHighPriority()
+	wait := goDone(WaitIfActive)
+	waitUntil(t, "the waiter to block", func() bool { return Waiters() == 1 })
+	Wake()
+	requireBlocked(t, wait, "WaitIfActive after a spurious Wake")
+	ExitHighPriority()
+	requireDone(t, wait, "WaitIfActive")
+}
+
+func TestWakeQueuedAndPausedWaiters(t *testing.T) {
+	resetForTest(t)
+	SetFairWakeups(true)
+
+	EnterHighPriority()
+	queued := goDone(WaitIfActive)
+	waitUntil(t, "the waiter to queue", func() bool { return queuedLen() == 1 })
+	Mu.Lock()
+	first := waitQueue[0]
+	Mu.Unlock()
+	Wake()
+	waitUntil(t, "the waiter to queue again", func() bool {
+		Mu.Lock()
+		defer Mu.Unlock()
+		return len(waitQueue) == 1 && waitQueue[0] != first
+	})
+	requireBlocked(t, queued, "queued WaitIfActive after a spurious Wake")
+	ExitHighPriority()
+	requireDone(t, queued, "queued WaitIfActive")
+
+	rec := recordEvents(t)
+	Pause()
+	defer Resume()
+	ch := resumedChan()
+	pausedWaiter := goDone(MaybeYield)
+	waitUntil(t, "the goroutine to pause", func() bool {
+		return slices.Contains(reasons(rec.Snapshot()), ReasonPausedAtYieldPoint)
+	})
+	Wake()
+	select {
+	case <-ch:
+	default:
+		t.Fatal("Wake did not wake goroutines blocked by Pause")
+	}
+	if !IsPaused() {
+		t.Fatal("Wake resumed the package")
+	}
+	requireBlocked(t, pausedWaiter, "paused MaybeYield after Wake")
+	Resume()
+	requireDone(t, pausedWaiter, "paused MaybeYield")
+}
+
+func TestPriorityRWMutex(t *testing.T) {
+	resetForTest(t)
+
+	var m PriorityRWMutex
+	m.Lock()
+	if !IsHighPriorityActive() {
+		t.Fatal("Lock did not enter a high-priority section")
+	}
+	if m.TryRLock() {
+		t.Fatal("TryRLock succeeded while write-locked")
+	}
+	m.Unlock()
+	if IsHighPriorityActive() {
+		t.Fatal("Unlock did not exit the high-priority section")
+	}
+
+	m.RLock()
+	m.RLocker().Lock()
+	if IsHighPriorityActive() {
+		t.Fatal("RLock entered a high-priority section")
+	}
+	m.RLocker().Unlock()
+	m.RUnlock()
+}
+
+func TestWorkerQuiescence(t *testing.T) {
+	resetForTest(t)
+
+	w := Register()
+	defer w.Unregister()
+
+	var stop atomic.Bool
+	done := goDone(func() {
+		for !stop.Load() {
+			w.MaybeYield()
+			time.Sleep(10 * time.Microsecond)
+		}
+	})
+
+	EnterHighPriority()
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := AwaitQuiescence(ctx); err != nil {
+		t.Fatalf("AwaitQuiescence: %v", err)
+	}
+	stop.Store(true)
+	ExitHighPriority()
+	requireDone(t, done, "worker")
+}
+
+func TestWorkerQuiescenceWhilePaused(t *testing.T) {
+	resetForTest(t)
+
+	w := Register()
+	defer w.Unregister()
+
+	Pause()
+	done := goDone(w.MaybeYield)
+	requireBlocked(t, done, "Worker.MaybeYield while paused")
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := AwaitQuiescence(ctx); err != nil {
+		t.Fatalf("AwaitQuiescence while paused: %v", err)
+	}
+	Resume()
+	requireDone(t, done, "Worker.MaybeYield after Resume")
+}
+
+func TestErrorsWrapContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := contextError(ctx)
+	if !errors.Is(err, ErrCancelled) || !errors.Is(err, context.Canceled) || errors.Is(err, ErrTimeout) {
+		t.Fatalf("contextError of a cancelled context = %v", err)
+	}
+
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now())
+	defer cancel()
+	err = contextError(ctx)
+	if !errors.Is(err, ErrTimeout) || !errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrCancelled) {
+		t.Fatalf("contextError of an expired context = %v", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	resetForTest(t)
+	SetYieldAction(func() {})
+
+	EnterHighPriority()
+	MaybeYield()
+	MaybeYield()
+	done := goDone(WaitIfActive)
+	waitUntil(t, "the waiter to block", func() bool { return Waiters() == 1 })
+	time.Sleep(time.Millisecond)
+	ExitHighPriority()
+	requireDone(t, done, "WaitIfActive")
+
+	s := Stats()
+	if s.Yields != 2 || s.Waits != 1 {
+		t.Fatalf("Stats = %d yields, %d waits, want 2 and 1", s.Yields, s.Waits)
+	}
+	if s.WaitTime <= 0 || s.MaxWait <= 0 || s.MaxWait > s.WaitTime {
+		t.Fatalf("WaitTime = %v, MaxWait = %v", s.WaitTime, s.MaxWait)
+	}
+	if s.HoldTime < time.Millisecond || s.MaxHold < time.Millisecond {
+		t.Fatalf("HoldTime = %v, MaxHold = %v, want at least 1ms", s.HoldTime, s.MaxHold)
+	}
+	if s.Active != 0 || s.Waiters != 0 {
+		t.Fatalf("gauges = %d active, %d waiters, want 0", s.Active, s.Waiters)
+	}
+
+	ResetStats()
+	s = Stats()
+	if s.Yields != 0 || s.Waits != 0 || s.WaitTime != 0 || s.HoldTime != 0 || s.MaxHold != 0 {
+		t.Fatalf("Stats after ResetStats = %+v", s)
+	}
+}
+
+func TestStatsByReason(t *testing.T) {
+	resetForTest(t)
+
+	EnterHighPriority()
+	ExitHighPriority()
+	EnterHighPriority()
+	ExitHighPriority()
+
+	by := Stats().ByReason
+	if by[ReasonEnterHighPriority] != 2 || by[ReasonExitHighPriority] != 2 {
+		t.Fatalf("ByReason = %v without a trace func", by)
+	}
+	if _, ok := by[ReasonWaitComplete]; ok {
+		t.Fatalf("ByReason contains a reason with no events: %v", by)
+	}
+}
+
+func TestActiveTime(t *testing.T) {
+	resetForTest(t)
+
+	before := ActiveTime()
+	EnterHighPriority()
+	time.Sleep(10 * time.Millisecond)
+	if d := ActiveTime() - before; d < 10*time.Millisecond {
+		t.Fatalf("ActiveTime grew by %v during a 10ms section", d)
+	}
+	ExitHighPriority()
+	after := ActiveTime()
+	time.Sleep(5 * time.Millisecond)
+	if got := ActiveTime(); got != after {
+		t.Fatalf("ActiveTime grew from %v to %v while idle", after, got)
+	}
+	if r := ActiveRatio(time.Hour); r <= 0 || r > 1 {
+		t.Fatalf("ActiveRatio = %v", r)
+	}
+	if r := ActiveRatio(0); r != 0 {
+		t.Fatalf("ActiveRatio(0) = %v", r)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	resetForTest(t)
+	SetYieldAction(func() { time.Sleep(time.Millisecond) })
+
+	EnterHighPriority()
+	MaybeYield()
+	ExitHighPriority()
+
+	h := Histogram()
+	if got := h.Total(); got != 1 {
+		t.Fatalf("Histogram().Total = %d, want 1", got)
+	}
+	if q := h.Quantile(0.5); q < 500*time.Microsecond {
+		t.Fatalf("median of a 1ms yield = %v", q)
+	}
+
+	ResetStats()
+	if got := Histogram().Total(); got != 0 {
+		t.Fatalf("Histogram().Total = %d after ResetStats", got)
+	}
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	s := HistogramSnapshot{Bounds: histogramBounds(), Counts: make([]uint64, histogramBuckets)}
+	if got := s.Quantile(0.5); got != 0 {
+		t.Fatalf("Quantile of an empty snapshot = %v", got)
+	}
+
+	// Bucket 3 holds durations in [4µs, 8µs).
+	s.Counts[3] = 100
+	for _, tc := range []struct {
+		q    float64
+		want time.Duration
+	}{
+		{0, 4 * time.Microsecond},
+		{0.5, 6 * time.Microsecond},
+		{1, 8 * time.Microsecond},
+		{2, 8 * time.Microsecond},
+	} {
+		if got := s.Quantile(tc.q); got != tc.want {
+			t.Errorf("Quantile(%v) = %v, want %v", tc.q, got, tc.want)
+		}
+	}
+
+	m := s.Merge(s)
+	if m.Total() != 200 || m.Counts[3] != 200 {
+		t.Fatalf("Merge = %v", m.Counts)
+	}
+	if got := m.Quantile(0.5); got != 6*time.Microsecond {
+		t.Fatalf("Quantile(0.5) of the merge = %v", got)
+	}
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	resetHistogram()
+	defer resetHistogram()
+
+	for _, d := range []time.Duration{0, 999 * time.Nanosecond, time.Microsecond, 3 * time.Microsecond, time.Hour} {
+		observeDuration(d)
+	}
+	h := Histogram()
+	want := map[int]uint64{0: 2, 1: 1, 2: 1, histogramBuckets - 1: 1}
+	for i, c := range h.Counts {
+		if c != want[i] {
+			t.Fatalf("bucket %d = %d, want %d (counts %v)", i, c, want[i], h.Counts)
+		}
+	}
+}
+
+func TestGoroutineID(t *testing.T) {
+	id := getGoroutineID()
+	if id == 0 {
+		t.Fatal("getGoroutineID returned 0")
+	}
+	var other uint64
+	<-goDone(func() { other = getGoroutineID() })
+	if other == 0 || other == id {
+		t.Fatalf("getGoroutineID on another goroutine = %d, this goroutine = %d", other, id)
+	}
+}
+
+func TestGoroutineIDNonZero(t *testing.T) {
+	ids := make(chan uint64, 100)
+	for range cap(ids) {
+		go func() { ids <- getGoroutineID() }()
+	}
+	seen := make(map[uint64]bool)
+	for range cap(ids) {
+		id := <-ids
+		if id == 0 || id >= 1<<63 {
+			t.Fatalf("getGoroutineID = %d, want an ID parsed from the stack", id)
+		}
+		if seen[id] {
+			t.Fatalf("getGoroutineID returned %d on two live goroutines", id)
+		}
+		seen[id] = true
+	}
+
+	a, b := fallbackGoroutineID.Add(1), fallbackGoroutineID.Add(1)
+	if a < 1<<63 || b <= a {
+		t.Fatalf("fallback IDs %d, %d are not increasing in the reserved range", a, b)
+	}
+}
+
+func TestParseGoroutineID(t *testing.T) {
+	tests := []struct {
+		header string
+		want   uint64
+		ok     bool
+	}{
+		{"goroutine 1 [running]:\nmain.main()", 1, true},
+		{"goroutine 18446744073709551615 [running]:", math.MaxUint64, true},
+		{"goroutine 42 gp=0xc000002380 m=0 mp=0x5a4d60 [running]:", 42, true},
+		{"goroutine 7 [chan receive, 3 minutes]:", 7, true},
+		{"goroutine 18446744073709551616 [running]:", 0, false},
+		{"goroutine 0 [running]:", 0, false},
+		{"goroutine [running]:", 0, false},
+		{"goroutine 12", 0, false},
+		{"goroutine 12x [running]:", 0, false},
+		{"thread 12 [running]:", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		if got, ok := parseGoroutineID([]byte(tt.header)); got != tt.want || ok != tt.ok {
+			t.Errorf("parseGoroutineID(%q) = %d, %v, want %d, %v", tt.header, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestReasonNames(t *testing.T) {
+	for r := range numBuiltinReasons {
+		if r.String() == "" || strings.HasPrefix(r.String(), "Reason(") {
+			t.Errorf("reason %d has no name", r)
+		}
+	}
+	if got := ReasonWaitComplete.String(); got != "wait_complete" {
+		t.Fatalf("ReasonWaitComplete.String() = %q", got)
+	}
+
+	r := RegisterReason("test_custom_reason")
+	if r < numBuiltinReasons {
+		t.Fatalf("RegisterReason returned builtin reason %d", r)
+	}
+	if again := RegisterReason("test_custom_reason"); again != r {
+		t.Fatalf("registering the same name twice gave %d and %d", r, again)
+	}
+	if got := r.String(); got != "test_custom_reason" {
+		t.Fatalf("String() = %q", got)
+	}
+	if got := Reason(1 << 30).String(); got != "Reason(1073741824)" {
+		t.Fatalf("String() of an unknown reason = %q", got)
+	}
+}
+
+func TestTraceEvents(t *testing.T) {
+	resetForTest(t)
+	rec := recordEvents(t)
+
+	EnterHighPriority()
+	done := goDone(WaitIfActive)
+	waitUntil(t, "the waiter to block", func() bool { return Waiters() == 1 })
+	ExitHighPriority()
+	requireDone(t, done, "WaitIfActive")
+
+	got := reasons(rec.Snapshot())
+	want := []Reason{ReasonEnterHighPriority, ReasonWaitStart, ReasonExitHighPriority, ReasonWaitComplete}
+	if !slices.Equal(got, want) {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+	for _, e := range rec.Snapshot() {
+		if e.GoroutineID == 0 || e.Timestamp.IsZero() {
+			t.Fatalf("event without goroutine ID or timestamp: %+v", e)
+		}
+	}
+}
+
+func TestBlockingAPIsTraceAndRecordWaits(t *testing.T) {
+	canceledCtx := func(f func(context.Context) error) func() {
+		return func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+			defer cancel()
+			_ = f(ctx)
+		}
+	}
+	tests := []struct {
+		name string
+		// active enters a section before the call and exits it after a delay;
+		// otherwise a section is entered after the delay and exited once the call returns.
+		active   bool
+		call     func()
+		want     []Reason
+		canceled uint64
+	}{
+		{
+			name:   "WaitIfActiveLimited",
+			active: true,
+			call:   func() { _ = WaitIfActiveLimited(10) },
+			want:   []Reason{ReasonWaitStart, ReasonWaitComplete},
+		},
+		{
+			name:   "MaybeYieldUntil",
+			active: true,
+			call:   func() { MaybeYieldUntil(time.Now().Add(testTimeout)) },
+			want:   []Reason{ReasonYieldUntilCleared},
+		},
+		{
+			name:   "MaybeYieldBlocking",
+			active: true,
+			call:   func() { MaybeYieldBlocking(testTimeout) },
+			want:   []Reason{ReasonYieldUntilCleared},
+		},
+		{
+			name:   "MaybeYieldBlocking/deadline",
+			active: true,
+			call:   func() { MaybeYieldBlocking(time.Millisecond) },
+			want:   []Reason{ReasonYieldUntilDeadline},
+		},
+		{
+			name:   "WaitForDepthBelow",
+			active: true,
+			call:   func() { WaitForDepthBelow(1) },
+			want:   []Reason{ReasonWaitStart, ReasonDepthWaitComplete},
+		},
+		{
+			name:     "WaitForDepthBelowWithContext/canceled",
+			active:   true,
+			call:     canceledCtx(func(ctx context.Context) error { return WaitForDepthBelowWithContext(ctx, 1) }),
+			want:     []Reason{ReasonWaitStart, ReasonWaitCanceled},
+			canceled: 1,
+		},
+		{
+			name: "WaitForHighPriority",
+			call: WaitForHighPriority,
+			want: []Reason{ReasonWaitStart, ReasonActivationWaitComplete},
+		},
+		{
+			name:     "WaitForHighPriorityWithContext/canceled",
+			call:     canceledCtx(WaitForHighPriorityWithContext),
+			want:     []Reason{ReasonWaitStart, ReasonWaitCanceled},
+			canceled: 1,
+		},
+		{
+			name:   "WaitForQuiet",
+			active: true,
+			call:   func() { WaitForQuiet(time.Millisecond) },
+			want:   []Reason{ReasonWaitStart, ReasonQuietWaitComplete},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			resetForTest(t)
+			rec := recordEvents(t)
+
+			release := EnterHighPriority
+			if tc.active {
+				EnterHighPriority()
+				release = ExitHighPriority
+			}
+			released := goDone(func() {
+				time.Sleep(10 * time.Millisecond)
+				release()
+			})
+			requireDone(t, goDone(tc.call), tc.name)
+			requireDone(t, released, "the release")
+			if !tc.active {
+				ExitHighPriority()
+			}
+
+			var got []Reason
+			for _, r := range reasons(rec.Snapshot()) {
+				if r != ReasonEnterHighPriority && r != ReasonExitHighPriority {
+					got = append(got, r)
+				}
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Fatalf("events = %v, want %v", got, tc.want)
+			}
+			if s := Stats(); s.Waits != 1 || s.Canceled != tc.canceled {
+				t.Fatalf("Waits = %d, Canceled = %d, want 1 and %d", s.Waits, s.Canceled, tc.canceled)
+			}
+		})
+	}
+}
+
+func TestSetTraceFuncReturnsPrevious(t *testing.T) {
+	resetForTest(t)
+
+	var a, b atomic.Int32
+	if prev := SetTraceFunc(func(YieldEvent) { a.Add(1) }); prev != nil {
+		t.Fatal("SetTraceFunc returned a previous func while tracing was off")
+	}
+	prev := SetTraceFunc(func(YieldEvent) { b.Add(1) })
+	EnterHighPriority()
+	SetTraceFunc(prev)
+	ExitHighPriority()
+
+	if a.Load() != 1 || b.Load() != 1 {
+		t.Fatalf("restored trace func got %d events, replacement got %d, want 1 each", a.Load(), b.Load())
+	}
+}
+
+func TestSetTraceFuncN(t *testing.T) {
+	resetForTest(t)
+	SetYieldAction(func() {})
+
+	const n = 50
+	var delivered atomic.Int32
+	SetTraceFuncN(func(YieldEvent) { delivered.Add(1) }, n)
+	EnterHighPriority()
+	defer ExitHighPriority()
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				MaybeYield()
+			}
+		}()
+	}
+	wg.Wait()
+	if got := delivered.Load(); got != n {
+		t.Fatalf("SetTraceFuncN delivered %d events, want %d", got, n)
+	}
+	if prev := SetTraceFunc(nil); prev != nil {
+		t.Fatal("SetTraceFuncN left tracing on after its last event")
+	}
+
+	SetTraceFuncN(func(YieldEvent) { delivered.Add(1) }, 0)
+	MaybeYield()
+	if got := delivered.Load(); got != n {
+		t.Fatalf("SetTraceFuncN with n = 0 delivered %d events", got-n)
+	}
+}
+
+func TestSetTraceBatch(t *testing.T) {
+	resetForTest(t)
+
+	var mu sync.Mutex
+	var sizes []int
+	SetTraceBatch(3, 0, func(batch []YieldEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		sizes = append(sizes, len(batch))
+	})
+	batches := func() []int {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(sizes)
+	}
+
+	for range 4 {
+		EnterHighPriority()
+		ExitHighPriority()
+	}
+	waitUntil(t, "two full batches", func() bool { return len(batches()) == 2 })
+	time.Sleep(blockedFor)
+	if got := batches(); len(got) != 2 {
+		t.Fatalf("batch sizes = %v, a partial batch was delivered without a flush interval", got)
+	}
+
+	StopTraceBatch()
+	if got := batches(); !slices.Equal(got, []int{3, 3, 2}) {
+		t.Fatalf("batch sizes = %v, want [3 3 2]", got)
+	}
+	EnterHighPriority()
+	ExitHighPriority()
+	if got := batches(); len(got) != 3 {
+		t.Fatalf("batch sizes = %v after StopTraceBatch", got)
+	}
+}
+
+func TestSetTraceBatchTimedFlush(t *testing.T) {
+	resetForTest(t)
+
+	got := make(chan []YieldEvent, 1)
+	SetTraceBatch(100, 5*time.Millisecond, func(batch []YieldEvent) { got <- batch })
+	EnterHighPriority()
+	ExitHighPriority()
+
+	select {
+	case batch := <-got:
+		if r := reasons(batch); !slices.Equal(r, []Reason{ReasonEnterHighPriority, ReasonExitHighPriority}) {
+			t.Fatalf("flushed batch = %v", r)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("partial batch was not flushed on time")
+	}
+}
+
+func TestAddTraceFuncIsolatesPanics(t *testing.T) {
+	resetForTest(t)
+
+	var got atomic.Int32
+	removePanic := AddTraceFunc(func(YieldEvent) { panic("subscriber bug") })
+	remove := AddTraceFunc(func(YieldEvent) { got.Add(1) })
+	EnterHighPriority()
+	ExitHighPriority()
+	if got.Load() != 2 {
+		t.Fatalf("second subscriber got %d events, want 2", got.Load())
+	}
+
+	remove()
+	remove()
+	removePanic()
+	EnterHighPriority()
+	ExitHighPriority()
+	if got.Load() != 2 {
+		t.Fatal("removed subscriber still receives events")
+	}
+}
+
+func TestWrapTraceFuncRace(t *testing.T) {
+	resetForTest(t)
+	rec := NewRecorder(16)
+	SetTraceFunc(rec.Record)
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for range 200 {
+				prev := WrapTraceFunc(func(next func(YieldEvent)) func(YieldEvent) {
+					return func(e YieldEvent) { next(e) }
+				})
+				SetTraceFunc(prev)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for range 200 {
+				EnterHighPriority()
+				ExitHighPriority()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if prev := WrapTraceFunc(func(next func(YieldEvent)) func(YieldEvent) { return next }); prev == nil {
+		t.Fatal("tracing was turned off by concurrent wraps")
+	}
+}
+
+func TestWrapTraceFuncWhileOff(t *testing.T) {
+	resetForTest(t)
+
+	var got atomic.Int32
+	WrapTraceFunc(func(next func(YieldEvent)) func(YieldEvent) {
+		return func(e YieldEvent) {
+			got.Add(1)
+			next(e)
+		}
+	})
+	EnterHighPriority()
+	ExitHighPriority()
+	if got.Load() != 2 {
+		t.Fatalf("middleware got %d events, want 2", got.Load())
+	}
+}
+
+func TestTraceCallers(t *testing.T) {
+	resetForTest(t)
+	rec := recordEvents(t)
+	SetTraceCallers(true)
+
+	// Enter through a function outside the package, since this test belongs to it.
+	sync.OnceFunc(EnterHighPriority)()
+	ExitHighPriority()
+
+	e := rec.Snapshot()[0]
+	if !strings.HasPrefix(e.CallerFunction, "sync.") || e.CallerFile == "" || e.CallerLine == 0 {
+		t.Fatalf("caller = %s at %s:%d, want the sync.OnceFunc closure", e.CallerFunction, e.CallerFile, e.CallerLine)
+	}
+}
+
+func TestTraceStacks(t *testing.T) {
+	resetForTest(t)
+	rec := recordEvents(t)
+	SetTraceStacks(ReasonEnterHighPriority)
+
+	EnterHighPriority()
+	ExitHighPriority()
+
+	events := rec.Snapshot()
+	if !bytes.Contains(events[0].Stack, []byte("TestTraceStacks")) {
+		t.Fatalf("enter event stack does not contain the test:\n%s", events[0].Stack)
+	}
+	if events[1].Stack != nil {
+		t.Fatal("exit event carries a stack it was not selected for")
+	}
+}
+
+func TestTraceSampling(t *testing.T) {
+	resetForTest(t)
+	rec := recordEvents(t)
+	SetTraceSampling(0)
+
+	EnterHighPriority()
+	MaybeYieldIf(func() bool { return false })
+	ExitHighPriority()
+
+	got := reasons(rec.Snapshot())
+	if want := []Reason{ReasonEnterHighPriority, ReasonExitHighPriority}; !slices.Equal(got, want) {
+		t.Fatalf("events = %v, want only the exempt %v", got, want)
+	}
+	if f := TraceSampledFraction(); f != 0 {
+		t.Fatalf("TraceSampledFraction = %v, want 0", f)
+	}
+	if got := Stats().ByReason[ReasonYieldSuppressed]; got != 1 {
+		t.Fatalf("ByReason counted %d sampled-out events, want 1", got)
+	}
+
+	SetTraceSampling(1)
+	if f := TraceSampledFraction(); f != 1 {
+		t.Fatalf("TraceSampledFraction = %v with sampling off", f)
+	}
+}
+
+func TestTraceRateLimit(t *testing.T) {
+	resetForTest(t)
+	var got atomic.Int32
+	AddTraceFunc(func(e YieldEvent) {
+		if e.Reason == ReasonYieldSuppressed {
+			got.Add(1)
+		}
+	})
+	SetTraceRateLimit(5)
+
+	EnterHighPriority()
+	defer ExitHighPriority()
+	for range 100 {
+		MaybeYieldIf(func() bool { return false })
+	}
+	// The limit may restart once if the loop crosses a second boundary.
+	if n := got.Load(); n < 1 || n > 10 {
+		t.Fatalf("%d events delivered with a limit of 5 per second", n)
+	}
+}
+
+func TestTraceAsync(t *testing.T) {
+	for _, policy := range []DropPolicy{DropNewest, DropOldest} {
+		resetForTest(t)
+
+		release := make(chan struct{})
+		var mu sync.Mutex
+		var got []time.Duration
+		SetTraceFunc(func(e YieldEvent) {
+			<-release
+			mu.Lock()
+			got = append(got, e.Duration)
+			mu.Unlock()
+		})
+		SetTraceAsync(4, policy)
+
+		start := time.Now()
+		for i := range 20 {
+			traceYieldEvent(ReasonHighPriorityActive, time.Duration(i+1))
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Fatalf("emitting stalled for %v behind a blocked subscriber", d)
+		}
+		if TraceDropped() == 0 {
+			t.Fatal("no events dropped with a full buffer")
+		}
+
+		close(release)
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		if err := FlushTraces(ctx); err != nil {
+			t.Fatalf("FlushTraces: %v", err)
+		}
+		cancel()
+
+		mu.Lock()
+		last := got[len(got)-1]
+		mu.Unlock()
+		if policy == DropOldest && last != 20 {
+			t.Fatalf("DropOldest lost the newest event; last delivered = %d", last)
+		}
+		if policy == DropNewest && last == 20 {
+			t.Fatal("DropNewest delivered the newest event")
+		}
+	}
+}
+
+func TestRecorderOverflow(t *testing.T) {
+	r := NewRecorder(3)
+	for i := range 5 {
+		r.Record(YieldEvent{Duration: time.Duration(i)})
+	}
+	var got []time.Duration
+	for _, e := range r.Snapshot() {
+		got = append(got, e.Duration)
+	}
+	if want := []time.Duration{2, 3, 4}; !slices.Equal(got, want) {
+		t.Fatalf("Snapshot durations = %v, want %v", got, want)
+	}
+
+	var buf bytes.Buffer
+	if err := r.Dump(&buf); err != nil {
+		t.Fatalf("Dump: %v", err)
+	}
+	if n := strings.Count(buf.String(), "\n"); n != 3 {
+		t.Fatalf("Dump wrote %d lines, want 3", n)
+	}
+}
+
+func TestRecorderConcurrent(t *testing.T) {
+	r := NewRecorder(8)
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for range 1000 {
+				r.Record(YieldEvent{Reason: ReasonEnterHighPriority})
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				if n := len(r.Snapshot()); n > 8 {
+					t.Errorf("Snapshot returned %d events from a ring of 8", n)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// goldenEvents are fixed events for the golden file tests.
+var goldenEvents = []YieldEvent{
+	{
+		GoroutineID: 7,
+		Reason:      ReasonEnterHighPriority,
+		Timestamp:   time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC),
+	},
+	{
+		GoroutineID:    7,
+		Reason:         ReasonWaitComplete,
+		Duration:       1500 * time.Nanosecond,
+		Timestamp:      time.Date(2024, 1, 2, 3, 4, 5, 500000000, time.UTC),
+		CallerFile:     "/src/app/main.go",
+		CallerLine:     42,
+		CallerFunction: "main.work",
+		Wakeups:        3,
+		Generation:     12,
+	},
+	{
+		GoroutineID: 8,
+		Reason:      ReasonHighPriorityActive,
+		Duration:    2 * time.Millisecond,
+		Timestamp:   time.Date(2024, 1, 2, 3, 4, 6, 0, time.UTC),
+	},
+	{
+		GoroutineID: 9,
+		Reason:      ReasonWaitCompleteFast,
+		Duration:    40 * time.Microsecond,
+		Timestamp:   time.Date(2024, 1, 2, 3, 4, 7, 0, time.UTC),
+		SpinStage:   SpinStageYield,
+	},
+}
+
+// checkGolden compares got with testdata/name, rewriting the file with -update.
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("output does not match %s:\ngot:\n%s\nwant:\n%s", path, got, want)
+	}
+}
+
+func TestWriteCSVGolden(t *testing.T) {
+	r := NewRecorder(len(goldenEvents))
+	for _, e := range goldenEvents {
+		r.Record(e)
+	}
+	var buf bytes.Buffer
+	if err := r.WriteCSV(&buf); err != nil {
+		t.Fatalf("WriteCSV: %v", err)
+	}
+	checkGolden(t, "events.csv", buf.Bytes())
+}
+
+func TestCSVTracerMatchesWriteCSV(t *testing.T) {
+	var buf bytes.Buffer
+	tr := NewCSVTracer(&buf)
+	for _, e := range goldenEvents {
+		tr.Trace(e)
+	}
+	if tr.ErrorCount() != 0 || tr.LastError() != nil {
+		t.Fatalf("CSVTracer errors: %d, %v", tr.ErrorCount(), tr.LastError())
+	}
+	checkGolden(t, "events.csv", buf.Bytes())
+}
+
+// failingWriter fails every write
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestTracersCountWriteErrors(t *testing.T) {
+	c := NewCSVTracer(failingWriter{})
+	c.Trace(goldenEvents[0])
+	if c.ErrorCount() == 0 || c.LastError() == nil {
+		t.Fatal("CSVTracer did not record a write error")
+	}
+
+	j := NewJSONTracer(failingWriter{})
+	j.Trace(goldenEvents[0])
+	if j.ErrorCount() != 1 || j.LastError() == nil {
+		t.Fatalf("JSONTracer recorded %d errors", j.ErrorCount())
+	}
+}
+
+func TestJSONTracerRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	tr := NewJSONTracer(&buf)
+	for _, e := range goldenEvents {
+		tr.Trace(e)
+	}
+
+	dec := json.NewDecoder(&buf)
+	for _, want := range goldenEvents {
+		var got jsonEvent
+		if err := dec.Decode(&got); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		ts, err := time.Parse(time.RFC3339Nano, got.Timestamp)
+		if err != nil {
+			t.Fatalf("timestamp %q: %v", got.Timestamp, err)
+		}
+		if !ts.Equal(want.Timestamp) || got.GoroutineID != want.GoroutineID ||
+			got.Reason != want.Reason.String() || time.Duration(got.DurationNanos) != want.Duration ||
+			got.CallerFile != want.CallerFile || got.CallerLine != want.CallerLine ||
+			got.CallerFunction != want.CallerFunction || got.SpinStage != want.SpinStage.String() ||
+			got.Generation != want.Generation {
+			t.Fatalf("round trip of %+v gave %+v", want, got)
+		}
+	}
+}
+
+func TestBufferedJSONTracer(t *testing.T) {
+	var mu sync.Mutex
+	var buf bytes.Buffer
+	w := writerFunc(func(p []byte) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return buf.Write(p)
+	})
+
+	tr := NewBufferedJSONTracer(w, time.Hour)
+	tr.Trace(goldenEvents[0])
+	mu.Lock()
+	n := buf.Len()
+	mu.Unlock()
+	if n != 0 {
+		t.Fatal("buffered tracer wrote before a flush")
+	}
+	if err := tr.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if !strings.Contains(buf.String(), `"reason":"enter_high_priority"`) {
+		t.Fatalf("Close did not flush the event: %q", buf.String())
+	}
+}
+
+// writerFunc adapts a func to io.Writer
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func TestSlogTracer(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	NewSlogTracer(logger, slog.LevelDebug)(goldenEvents[1])
+
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("decode %q: %v", buf.String(), err)
+	}
+	if got["reason"] != "wait_complete" || got["goroutine_id"] != float64(7) || got["caller_line"] != float64(42) ||
+		got["generation"] != float64(12) {
+		t.Fatalf("slog record = %v", got)
+	}
+
+	buf.Reset()
+	quiet := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	NewSlogTracer(quiet, slog.LevelDebug)(goldenEvents[1])
+	if buf.Len() != 0 {
+		t.Fatalf("tracer logged below the handler's level: %q", buf.String())
+	}
+}
+
+func TestLabels(t *testing.T) {
+	resetForTest(t)
+
+	a1 := EnterHighPriorityLabeled("a")
+	a2 := EnterHighPriorityLabeled("a")
+	b := EnterHighPriorityLabeled("b")
+	if got := ActiveLabels(); len(got) != 2 || got["a"] != 2 || got["b"] != 1 {
+		t.Fatalf("ActiveLabels = %v", got)
+	}
+
+	barrier := HighPriorityBarrier()
+	late := EnterHighPriorityLabeled("late")
+	a1()
+	a1()
+	a2()
+	select {
+	case <-barrier:
+		t.Fatal("barrier closed with a section still open")
+	default:
+	}
+	b()
+	requireDone(t, barrier, "HighPriorityBarrier")
+	late()
+
+	if got := ActiveLabels(); len(got) != 0 {
+		t.Fatalf("ActiveLabels = %v after all released", got)
+	}
+	if got := HighPriorityDepth(); got != 0 {
+		t.Fatalf("HighPriorityDepth = %d after all released", got)
+	}
+	select {
+	case <-HighPriorityBarrier():
+	default:
+		t.Fatal("barrier with no open sections is not closed")
+	}
+}
+
+func TestGoroutineDepthTracking(t *testing.T) {
+	resetForTest(t)
+
+	var deltas []int
+	SetImbalanceHandler(func(delta int) { deltas = append(deltas, delta) })
+	SetGoroutineDepthTracking(true)
+
+	EnterHighPriority()
+	EnterHighPriority()
+	if got := GoroutineEnterDepth(); got != 2 {
+		t.Fatalf("GoroutineEnterDepth = %d, want 2", got)
+	}
+
+	var other int
+	<-goDone(func() {
+		other = GoroutineEnterDepth()
+		ExitHighPriority()
+	})
+	if other != 0 {
+		t.Fatalf("GoroutineEnterDepth on another goroutine = %d", other)
+	}
+	if got := HighPriorityDepth(); got != 2 {
+		t.Fatalf("exit from a goroutine with no sections ended one; depth = %d", got)
+	}
+	if !slices.Equal(deltas, []int{1}) {
+		t.Fatalf("imbalance handler called with %v, want [1]", deltas)
+	}
+
+	ExitHighPriority()
+	ExitHighPriority()
+	if got := GoroutineEnterDepth(); got != 0 {
+		t.Fatalf("GoroutineEnterDepth = %d after exiting", got)
+	}
+}
+
+func TestInHighPrioritySection(t *testing.T) {
+	resetForTest(t)
+
+	EnterHighPriority()
+	if InHighPrioritySection() {
+		t.Fatal("InHighPrioritySection = true with depth tracking disabled")
+	}
+	ExitHighPriority()
+
+	SetGoroutineDepthTracking(true)
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	var inside bool
+	holder := goDone(func() {
+		EnterHighPriority()
+		defer ExitHighPriority()
+		inside = InHighPrioritySection()
+		close(entered)
+		<-release
+	})
+	<-entered
+	if InHighPrioritySection() {
+		t.Fatal("InHighPrioritySection = true on a goroutine that only observes a section")
+	}
+	close(release)
+	requireDone(t, holder, "section holder")
+	if !inside {
+		t.Fatal("InHighPrioritySection = false on the goroutine that entered the section")
+	}
+}
+
+func TestSelfWaitDetected(t *testing.T) {
+	waits := map[string]func(){
+		"WaitIfActive":            WaitIfActive,
+		"WaitIfActiveFast":        WaitIfActiveFast,
+		"WaitIfActiveWithContext": func() { _ = WaitIfActiveWithContext(context.Background()) },
+		"WaitIfActiveLimited":     func() { _ = WaitIfActiveLimited(0) },
+		"WaitForQuiet":            func() { WaitForQuiet(time.Millisecond) },
+	}
+	for name, wait := range waits {
+		t.Run(name, func(t *testing.T) {
+			resetForTest(t)
+			SetGoroutineDepthTracking(true)
+			r := recordEvents(t)
+
+			release := make(chan struct{})
+			holder := goDone(func() {
+				EnterHighPriority()
+				defer ExitHighPriority()
+				wait()
+				<-release
+			})
+			waitUntil(t, "the holder to detect its self-wait", func() bool {
+				return slices.Contains(reasons(r.Snapshot()), ReasonSelfWaitDetected)
+			})
+			requireBlocked(t, goDone(wait), name+" on another goroutine")
+			close(release)
+			requireDone(t, holder, "section holder")
+		})
+	}
+}
+
+func TestSelfWaitPanic(t *testing.T) {
+	resetForTest(t)
+	SetGoroutineDepthTracking(true)
+	SetSelfWaitPanic(true)
+	r := recordEvents(t)
+
+	EnterHighPriority()
+	defer ExitHighPriority()
+	defer func() {
+		msg, _ := recover().(string)
+		if !strings.Contains(msg, "WaitIfActiveFast") {
+			t.Fatalf("panic message %q does not name WaitIfActiveFast", msg)
+		}
+		if !slices.Contains(reasons(r.Snapshot()), ReasonSelfWaitDetected) {
+			t.Fatal("no self_wait_detected event before the panic")
+		}
+	}()
+	WaitIfActiveFast()
+	t.Fatal("WaitIfActiveFast returned on a self-wait with SetSelfWaitPanic enabled")
+}
+
+func TestGoroutineDepthTrackingUntracked(t *testing.T) {
+	resetForTest(t)
+
+	EnterHighPriority()
+	SetGoroutineDepthTracking(true)
+	<-goDone(ExitHighPriority)
+	if got := HighPriorityDepth(); got != 0 {
+		t.Fatalf("section open before tracking could not be exited elsewhere; depth = %d", got)
+	}
+}
+
+func TestEnterHighPriorityFor(t *testing.T) {
+	resetForTest(t)
+
+	var deltas atomic.Int32
+	SetImbalanceHandler(func(delta int) { deltas.Add(int32(delta)) })
+
+	EnterHighPriorityFor(5 * time.Millisecond)
+	waitUntil(t, "the timed section to exit", func() bool { return HighPriorityDepth() == 0 })
+
+	cancel := EnterHighPriorityFor(time.Hour)
+	cancel()
+	cancel()
+	if got := HighPriorityDepth(); got != 0 {
+		t.Fatalf("HighPriorityDepth = %d after cancel", got)
+	}
+
+	cancel = EnterHighPriorityFor(time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	cancel()
+	if got := deltas.Load(); got != 0 {
+		t.Fatalf("timed section exited twice; imbalance %d", got)
+	}
+}
+
+func TestDoHighPriority(t *testing.T) {
+	resetForTest(t)
+
+	DoHighPriority(context.Background(), func(ctx context.Context) {
+		if !IsHighPriorityActive() {
+			t.Error("fn ran outside a high-priority section")
+		}
+		if v, ok := pprof.Label(ctx, "yieldpoint_priority"); !ok || v != "high" {
+			t.Errorf("yieldpoint_priority label = %q, %v", v, ok)
+		}
+	})
+	if IsHighPriorityActive() {
+		t.Fatal("section still active after DoHighPriority")
+	}
+
+	func() {
+		defer func() { _ = recover() }()
+		DoHighPriority(context.Background(), func(context.Context) { panic("boom") })
+	}()
+	if IsHighPriorityActive() {
+		t.Fatal("section still active after fn panicked")
+	}
+}
+
+func TestWaitProfileLabels(t *testing.T) {
+	resetForTest(t)
+	SetWaitProfileLabels(true)
+
+	EnterHighPriority()
+	ctx := pprof.WithLabels(context.Background(), pprof.Labels("job", "batch"))
+	errs := make(chan error, 1)
+	go func() { errs <- WaitIfActiveWithContext(ctx) }()
+	waitUntil(t, "the waiter to block", func() bool { return Waiters() == 1 })
+	ExitHighPriority()
+	if err := <-errs; err != nil {
+		t.Fatalf("labeled wait: %v", err)
+	}
+}
+
+func TestRuntimeTrace(t *testing.T) {
+	resetForTest(t)
+
+	var buf bytes.Buffer
+	if err := trace.Start(&buf); err != nil {
+		t.Skipf("execution trace already running: %v", err)
+	}
+	EnableRuntimeTrace(true)
+	SetYieldAction(func() {})
+
+	EnterHighPriority()
+	MaybeYield()
+	done := goDone(WaitIfActive)
+	waitUntil(t, "the waiter to block", func() bool { return Waiters() == 1 })
+	ExitHighPriority()
+	requireDone(t, done, "WaitIfActive")
+	trace.Stop()
+
+	for _, name := range []string{"yieldpoint.HighPriority", "yieldpoint.MaybeYield", "yieldpoint.WaitIfActive"} {
+		if !bytes.Contains(buf.Bytes(), []byte(name)) {
+			t.Errorf("execution trace does not mention %s", name)
+		}
+	}
+}
+
+func TestPublishExpvar(t *testing.T) {
+	resetForTest(t)
+
+	PublishExpvar("yieldpoint_test")
+	PublishExpvar("yieldpoint_test")
+
+	EnterHighPriority()
+	defer ExitHighPriority()
+
+	var got struct {
+		ActiveSections int32             `json:"active_sections"`
+		ByReason       map[string]uint64 `json:"by_reason"`
+	}
+	if err := json.Unmarshal([]byte(expvar.Get("yieldpoint_test").String()), &got); err != nil {
+		t.Fatalf("decode expvar: %v", err)
+	}
+	if got.ActiveSections != 1 || got.ByReason["enter_high_priority"] != 1 {
+		t.Fatalf("expvar = %+v", got)
+	}
+}
+
+func TestTopYielders(t *testing.T) {
+	resetForTest(t)
+
+	if got := TopYielders(1); got != nil {
+		t.Fatalf("TopYielders = %v with accounting off", got)
+	}
+	SetGoroutineAccounting(true, time.Minute)
+	SetYieldAction(func() { time.Sleep(time.Millisecond) })
+
+	EnterHighPriority()
+	for range 3 {
+		MaybeYield()
+	}
+	<-goDone(MaybeYield)
+	ExitHighPriority()
+
+	top := TopYielders(5)
+	if len(top) != 2 {
+		t.Fatalf("TopYielders = %v, want 2 goroutines", top)
+	}
+	if top[0].GoroutineID != getGoroutineID() || top[0].Yields != 3 || top[0].BlockedTime < 3*time.Millisecond {
+		t.Fatalf("top yielder = %+v", top[0])
+	}
+	if got := TopYielders(1); len(got) != 1 {
+		t.Fatalf("TopYielders(1) returned %d entries", len(got))
+	}
+}
+
+func TestPacer(t *testing.T) {
+	resetForTest(t)
+
+	p := NewPacer(0.5)
+	for range 1000 {
+		p.Tick()
+	}
+	if p.Stride() < 1 {
+		t.Fatalf("Stride = %d", p.Stride())
+	}
+
+	SetTestMode(true)
+	EnterHighPriority()
+	defer ExitHighPriority()
+	p = NewPacer(0.01)
+	p.Tick()
+	if got := YieldIntents(); got != 1 {
+		t.Fatalf("Pacer with stride 1 did not yield; YieldIntents = %d", got)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	resetForTest(t)
+	rec := recordEvents(t)
+	EnterHighPriority()
+	defer ExitHighPriority()
+
+	// With a 1ns run phase every call lands in the sleep phase; test mode only counts it.
+	SetTestMode(true)
+	SetThrottle(1e-6, time.Second)
+	MaybeYield()
+	if err := MaybeYieldWithContext(context.Background()); err != nil {
+		t.Fatalf("MaybeYieldWithContext: %v", err)
+	}
+	if got := YieldIntents(); got != 2 {
+		t.Fatalf("YieldIntents = %d, want 2 throttle sleeps", got)
+	}
+	if got := Stats().Yields; got != 0 {
+		t.Fatalf("Yields = %d while throttled, want 0", got)
+	}
+	SetTestMode(false)
+
+	// A context done during the sleep ends it early.
+	SetThrottle(1e-6, time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	if err := MaybeYieldWithContext(ctx); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("MaybeYieldWithContext during a throttle sleep returned %v, want ErrTimeout", err)
+	}
+
+	SetThrottle(0.5, 2*time.Millisecond)
+	for deadline := time.Now().Add(20 * time.Millisecond); time.Now().Before(deadline); {
+		MaybeYield()
+	}
+	s := Stats()
+	if s.ThrottleSleeps == 0 || s.ThrottleSleepTime <= 0 {
+		t.Fatalf("ThrottleSleeps = %d, ThrottleSleepTime = %v after throttling", s.ThrottleSleeps, s.ThrottleSleepTime)
+	}
+	if got := s.ByReason[ReasonThrottleSleep]; got != s.ThrottleSleeps {
+		t.Fatalf("%d throttle_sleep events, want %d", got, s.ThrottleSleeps)
+	}
+	if !slices.Contains(reasons(rec.Snapshot()), ReasonThrottleSleep) {
+		t.Fatal("no throttle_sleep event traced")
+	}
+	if target, achieved := ThrottleDutyCycle(); target != 0.5 || achieved <= 0 || achieved > 1 {
+		t.Fatalf("ThrottleDutyCycle = %v, %v, want 0.5 and a fraction", target, achieved)
+	}
+
+	ResetStats()
+	SetThrottle(0, 0)
+	if target, achieved := ThrottleDutyCycle(); target != 0 || achieved != 0 {
+		t.Fatalf("ThrottleDutyCycle = %v, %v after reset, want 0, 0", target, achieved)
+	}
+}
+
+func TestMaybeYieldIdleDoesNotAllocate(t *testing.T) {
+	resetForTest(t)
+
+	if n := testing.AllocsPerRun(100, MaybeYield); n != 0 {
+		t.Fatalf("idle MaybeYield allocates %v times", n)
+	}
+
+	SetYieldAction(func() {})
+	EnterHighPriority()
+	defer ExitHighPriority()
+	if n := testing.AllocsPerRun(100, MaybeYield); n != 0 {
+		t.Fatalf("MaybeYield allocates %v times while active with tracing off", n)
+	}
+}
+
+func TestWithPriorityCeiling(t *testing.T) {
+	resetForTest(t)
+	SetTestMode(true)
+
+	var otherDone <-chan struct{}
+	WithPriorityCeiling(func() {
+		if !IsHighPriorityActive() {
+			t.Fatal("fn ran outside a high-priority section")
+		}
+		otherDone = goDone(WaitIfActive)
+		WaitIfActive()
+		WaitIfActiveFast()
+		if err := WaitIfActiveWithContext(context.Background()); err != nil {
+			t.Fatalf("WaitIfActiveWithContext inside the ceiling: %v", err)
+		}
+		if err := WaitIfActiveLimited(0); err != nil {
+			t.Fatalf("WaitIfActiveLimited inside the ceiling: %v", err)
+		}
+		WaitForDepthBelow(1)
+		if !MaybeYieldBlocking(time.Hour) || !MaybeYieldUntil(time.Now().Add(time.Hour)) {
+			t.Fatal("blocking yields inside the ceiling reported active sections")
+		}
+		WithPriorityCeiling(func() { WaitIfActive() })
+		MaybeYield()
+		MaybeYieldNonBlocking()
+		if got := YieldIntents(); got != 0 {
+			t.Fatalf("ceiling holder yielded %d times", got)
+		}
+
+		Pause()
+		MaybeYield()
+		WaitIfActive()
+		Resume()
+
+		start := time.Now()
+		PrioritySleep(5 * time.Millisecond)
+		if d := time.Since(start); d < 5*time.Millisecond {
+			t.Fatalf("PrioritySleep inside the ceiling returned after %v", d)
+		}
+
+		requireBlocked(t, otherDone, "another goroutine's WaitIfActive inside the ceiling")
+	})
+	requireDone(t, otherDone, "WaitIfActive after the ceiling")
+	if IsHighPriorityActive() {
+		t.Fatal("section still active after WithPriorityCeiling")
+	}
+	if holdsCeiling() {
+		t.Fatal("goroutine still exempt after WithPriorityCeiling")
+	}
+
+	func() {
+		defer func() { _ = recover() }()
+		WithPriorityCeiling(func() { panic("boom") })
+	}()
+	if IsHighPriorityActive() || holdsCeiling() {
+		t.Fatal("ceiling not released after fn panicked")
+	}
+}
+
+func TestEnterHighPriorityForWithDepthTracking(t *testing.T) {
+	resetForTest(t)
+
+	var deltas atomic.Int32
+	SetImbalanceHandler(func(delta int) { deltas.Add(int32(delta)) })
+	SetGoroutineDepthTracking(true)
+
+	EnterHighPriorityFor(5 * time.Millisecond)
+	if got := GoroutineEnterDepth(); got != 1 {
+		t.Fatalf("GoroutineEnterDepth = %d inside a timed section", got)
+	}
+	waitUntil(t, "the timed section to exit", func() bool { return HighPriorityDepth() == 0 })
+	if got := GoroutineEnterDepth(); got != 0 {
+		t.Fatalf("GoroutineEnterDepth = %d after the timer exited the section", got)
+	}
+
+	cancel := EnterHighPriorityFor(time.Hour)
+	<-goDone(cancel)
+	if got := HighPriorityDepth(); got != 0 {
+		t.Fatalf("cancel on another goroutine left depth %d", got)
+	}
+	if got := deltas.Load(); got != 0 {
+		t.Fatalf("timed exits reported as imbalanced: %d", got)
+	}
+}
+
+func TestActiveTimeMonotonicUnderChurn(t *testing.T) {
+	resetForTest(t)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					EnterHighPriority()
+					ExitHighPriority()
+				}
+			}
+		}()
+	}
+
+	var lastActive, lastHold time.Duration
+	deadline := time.Now().Add(100 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		active, hold := ActiveTime(), Stats().HoldTime
+		if active < lastActive || hold < lastHold {
+			close(stop)
+			wg.Wait()
+			t.Fatalf("went backwards: ActiveTime %v -> %v, HoldTime %v -> %v", lastActive, active, lastHold, hold)
+		}
+		lastActive, lastHold = active, hold
+	}
+	close(stop)
+	wg.Wait()
+
+	settled := ActiveTime()
+	time.Sleep(5 * time.Millisecond)
+	if got := ActiveTime(); got != settled {
+		t.Fatalf("ActiveTime still growing after all sections exited: %v -> %v", settled, got)
+	}
+}
+
+func TestWorkerNotParkedWhileIdle(t *testing.T) {
+	resetForTest(t)
+
+	w := Register()
+	defer w.Unregister()
+
+	var stop atomic.Bool
+	done := goDone(func() {
+		for !stop.Load() {
+			w.WaitIfActive()
+		}
+	})
+	defer requireDone(t, done, "worker")
+	defer stop.Store(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := AwaitQuiescence(ctx); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("AwaitQuiescence with a running worker returned %v, want ErrTimeout", err)
+	}
+}
+
+func TestPriorityRWMutexTryLock(t *testing.T) {
+	resetForTest(t)
+
+	var m PriorityRWMutex
+	if !m.TryLock() {
+		t.Fatal("TryLock failed on an unlocked mutex")
+	}
+	if !IsHighPriorityActive() {
+		t.Fatal("successful TryLock did not enter a high-priority section")
+	}
+	m.Unlock()
+
+	m.RLock()
+	defer m.RUnlock()
+	gen, events := Generation(), Stats().ByReason[ReasonEnterHighPriority]
+	if m.TryLock() {
+		t.Fatal("TryLock succeeded while read-locked")
+	}
+	if Generation() != gen || Stats().ByReason[ReasonEnterHighPriority] != events || IsHighPriorityActive() {
+		t.Fatal("failed TryLock entered a high-priority section")
+	}
+}
+
+func TestYieldBudget(t *testing.T) {
+	resetForTest(t)
+	SetDefaultYieldDuration(time.Millisecond)
+
+	b := NewYieldBudget(0, 2*time.Millisecond)
+	b.MaybeYield()
+	if got := b.Level(); got != 2*time.Millisecond {
+		t.Fatalf("idle MaybeYield drew from the budget; Level = %v", got)
+	}
+
+	EnterHighPriority()
+	defer ExitHighPriority()
+
+	SetTestMode(true)
+	b.MaybeYield()
+	if got := YieldIntents(); got != 1 {
+		t.Fatalf("YieldIntents = %d in test mode, want 1", got)
+	}
+	if got := b.Level(); got != time.Millisecond {
+		t.Fatalf("Level = %v after one sleep, want 1ms", got)
+	}
+
+	SetYieldDecider(func(int) bool { return false })
+	b.MaybeYield()
+	if got := YieldIntents(); got != 1 {
+		t.Fatal("budget yielded against the decider")
+	}
+	SetYieldDecider(nil)
+	SetTestMode(false)
+
+	rec := recordEvents(t)
+	var actions atomic.Int32
+	SetYieldAction(func() { actions.Add(1) })
+	start := time.Now()
+	b.MaybeYield()
+	if d := time.Since(start); d < time.Millisecond {
+		t.Fatalf("budgeted yield slept %v, want 1ms", d)
+	}
+	b.MaybeYield()
+	if got := actions.Load(); got != 1 {
+		t.Fatalf("yield action called %d times once the budget ran dry, want 1", got)
+	}
+	if got := Stats().Yields; got != 2 {
+		t.Fatalf("Yields = %d, want 2", got)
+	}
+	if got := Histogram().Total(); got != 2 {
+		t.Fatalf("Histogram().Total = %d, want 2", got)
+	}
+	var traced int
+	for _, e := range rec.Snapshot() {
+		if e.Reason == ReasonHighPriorityActive {
+			traced++
+		}
+	}
+	if traced != 2 {
+		t.Fatalf("%d yields traced, want 2", traced)
+	}
+}
+
+func TestSetYieldBudget(t *testing.T) {
+	resetForTest(t)
+	EnterHighPriority()
+	defer ExitHighPriority()
+
+	SetYieldBudget(3)
+	SetTestMode(true)
+	for range 10 {
+		MaybeYield()
+	}
+	if got := YieldIntents(); got != 3 {
+		t.Fatalf("YieldIntents = %d with a budget of 3, want 3", got)
+	}
+	if got := Stats().ByReason[ReasonYieldSuppressed]; got != 7 {
+		t.Fatalf("%d yields suppressed, want 7", got)
+	}
+
+	// Each goroutine has its own budget.
+	requireDone(t, goDone(func() {
+		for range 10 {
+			MaybeYield()
+		}
+	}), "yielding goroutine")
+	if got := YieldIntents(); got != 6 {
+		t.Fatalf("YieldIntents = %d after a second goroutine, want 6", got)
+	}
+
+	// Once the budget is used, even a sleeping yield returns at once.
+	SetTestMode(false)
+	SetDefaultYieldDuration(time.Second)
+	b := NewYieldBudget(0, time.Second)
+	start := time.Now()
+	b.MaybeYield()
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("yield beyond the budget took %v", d)
+	}
+	if got := b.Level(); got != time.Second {
+		t.Fatalf("yield beyond the budget drew from the YieldBudget; Level = %v", got)
+	}
+	if got := Stats().Yields; got != 0 {
+		t.Fatalf("Yields = %d beyond the budget, want 0", got)
+	}
+
+	SetYieldBudget(0)
+	SetTestMode(true)
+	MaybeYield()
+	if got := YieldIntents(); got != 1 {
+		t.Fatalf("YieldIntents = %d with no budget, want 1", got)
+	}
+}